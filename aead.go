@@ -0,0 +1,328 @@
+package secretun
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// AEADEncoder seals every packet with AES-GCM. Each sender picks a random
+// salt and derives its own key from the shared one, so both ends may use
+// the same key without ever reusing a nonce:
+//
+//	salt(8) | seq(8) | ciphertext | tag(16)
+//
+// seq counts up per sender and is checked against a sliding window, which
+// rejects replayed packets while tolerating reordering on udp. A decoder
+// only takes packets from the first peer salt it authenticates.
+//
+// Every connection uses the same shared key, so once bind mixes in the
+// nonces of the hello, the keys are new for each connection and packets
+// recorded from another one don't open. The top bit of seq marks packets
+// sealed with a bound key.
+type AEADEncoder struct {
+	lock  sync.Mutex
+	key   []byte
+	salt  [aeadSaltSize]byte
+	seal  cipher.AEAD
+	seq   uint64
+	bound []byte
+	// bseal is seal bound to the handshake, nil before bind
+	bseal cipher.AEAD
+	peer  *aeadPeer
+}
+
+type aeadPeer struct {
+	salt   [aeadSaltSize]byte
+	aead   cipher.AEAD
+	replay replayFilter
+}
+
+const (
+	aeadSaltSize   = 8
+	aeadSeqSize    = 8
+	aeadHeaderSize = aeadSaltSize + aeadSeqSize
+	aeadTagSize    = 16
+	aeadBoundSeq   = 1 << 63
+	aeadInfo       = "secretun aead"
+	aeadKeyIdInfo  = "secretun key id"
+
+	replayWindow = 1024
+)
+
+// replayFilter remembers the last replayWindow sequence numbers seen
+type replayFilter struct {
+	top  uint64
+	bits [replayWindow / 64]uint64
+}
+
+func (f *replayFilter) fresh(seq uint64) bool {
+	switch {
+	case seq == 0:
+		return false
+	case seq > f.top:
+		return true
+	case f.top-seq >= replayWindow:
+		return false
+	}
+	i := seq % replayWindow
+	return f.bits[i/64]&(1<<(i%64)) == 0
+}
+
+func (f *replayFilter) accept(seq uint64) {
+	if seq > f.top {
+		if seq-f.top >= replayWindow {
+			f.bits = [replayWindow / 64]uint64{}
+		} else {
+			for s := f.top + 1; s < seq; s++ {
+				i := s % replayWindow
+				f.bits[i/64] &^= 1 << (i % 64)
+			}
+		}
+		f.top = seq
+	}
+	i := seq % replayWindow
+	f.bits[i/64] |= 1 << (i % 64)
+}
+
+func (e *AEADEncoder) Init(cfg Config) error {
+	var cipher_name, key, key_file string
+
+	if err := cfg.GetOptional("cipher", &cipher_name); err != nil {
+		return err
+	} else if err := cfg.GetOptional("key", &key); err != nil {
+		return err
+	} else if err := cfg.GetOptional("key_file", &key_file); err != nil {
+		return err
+	}
+
+	switch cipher_name {
+	case "", "aes-gcm":
+	default:
+		return fmt.Errorf("aead: unsupported cipher: %s", cipher_name)
+	}
+
+	if len(key_file) > 0 {
+		data, err := ioutil.ReadFile(key_file)
+		if err != nil {
+			return fmt.Errorf("aead: %v", err)
+		}
+		key = strings.TrimSpace(string(data))
+	}
+	if len(key) == 0 {
+		return fmt.Errorf("aead: key or key_file is required")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("aead: key is not base64: %v", err)
+	}
+	return e.SetKey(raw)
+}
+
+// SetKey switches to a new 16, 24 or 32 byte key, forgets the peer and
+// the binding
+func (e *AEADEncoder) SetKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return fmt.Errorf("aead: key must be 16, 24 or 32 bytes, got %d", len(key))
+	}
+
+	var salt [aeadSaltSize]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return err
+	}
+	seal, err := aeadFor(key, salt, nil)
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.key = key
+	e.salt = salt
+	e.seal = seal
+	e.seq = 0
+	e.bound, e.bseal = nil, nil
+	e.peer = nil
+	return nil
+}
+
+// bind derives the keys of both directions from handshake as well from now
+// on. Packets sealed before stay readable by the peer until it binds too,
+// after that it only takes bound ones.
+func (e *AEADEncoder) bind(handshake []byte) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.seal == nil {
+		return fmt.Errorf("aead: no key")
+	}
+	bseal, err := aeadFor(e.key, e.salt, handshake)
+	if err != nil {
+		return err
+	}
+	if e.peer != nil {
+		if e.peer.aead, err = aeadFor(e.key, e.peer.salt, handshake); err != nil {
+			return err
+		}
+	}
+	e.bound, e.bseal = handshake, bseal
+	return nil
+}
+
+// Params tells peers which key is in use without revealing it
+func (e *AEADEncoder) Params() map[string]string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	id, _ := hkdf.Key(sha256.New, e.key, nil, aeadKeyIdInfo, 4)
+	return map[string]string{"cipher": "aes-gcm", "key_id": hex.EncodeToString(id)}
+}
+
+func aeadFor(key []byte, salt [aeadSaltSize]byte, handshake []byte) (cipher.AEAD, error) {
+	sub, err := hkdf.Key(sha256.New, key, salt[:], aeadInfo+string(handshake), len(key))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(sub)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func aeadNonce(seq []byte) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce[4:], seq)
+	return nonce
+}
+
+func (e *AEADEncoder) Encode(data []byte) ([]byte, error) {
+	return e.encode(data, true)
+}
+
+// encode is Encode, bound as for sealAt
+func (e *AEADEncoder) encode(data []byte, bound bool) ([]byte, error) {
+	buf := make([]byte, aeadHeaderSize+len(data), aeadHeaderSize+len(data)+aeadTagSize)
+	copy(buf[aeadHeaderSize:], data)
+	buf, off, err := e.sealAt(buf, aeadHeaderSize, bound)
+	if err != nil {
+		return nil, err
+	}
+	return buf[off:], nil
+}
+
+// sealAt seals buf[off:] in place if there is room for the header in front
+// of it and for the tag behind it, the sealed data is buf[off:] of the
+// result. It uses the bound key once there is one, unless bound is false.
+func (e *AEADEncoder) sealAt(buf []byte, off int, bound bool) ([]byte, int, error) {
+	if off < aeadHeaderSize || cap(buf)-len(buf) < aeadTagSize {
+		data, err := e.encode(buf[off:], bound)
+		return data, 0, err
+	}
+
+	e.lock.Lock()
+	if e.seal == nil {
+		e.lock.Unlock()
+		return nil, 0, fmt.Errorf("aead: no key")
+	}
+	e.seq++
+	seq, salt, seal := e.seq, e.salt, e.seal
+	if bound && e.bseal != nil {
+		seq, seal = seq|aeadBoundSeq, e.bseal
+	}
+	e.lock.Unlock()
+
+	header := buf[off-aeadHeaderSize : off]
+	copy(header, salt[:])
+	binary.BigEndian.PutUint64(header[aeadSaltSize:], seq)
+	plain := buf[off:]
+	seal.Seal(plain[:0], aeadNonce(header[aeadSaltSize:]), plain, header)
+	return buf[:len(buf)+aeadTagSize], off - aeadHeaderSize, nil
+}
+
+func (e *AEADEncoder) Decode(data []byte) ([]byte, error) {
+	if len(data) < aeadHeaderSize {
+		return nil, fmt.Errorf("aead: short packet")
+	}
+	var salt [aeadSaltSize]byte
+	copy(salt[:], data)
+	seq := binary.BigEndian.Uint64(data[aeadSaltSize:])
+	bound := seq&aeadBoundSeq != 0
+	seq &^= aeadBoundSeq
+
+	// decode workers only take the lock to find the peer and for the
+	// window, not while opening
+	e.lock.Lock()
+	p, err := e.peerFor(salt, seq, bound)
+	var aead cipher.AEAD
+	if p != nil {
+		aead = p.aead
+	}
+	e.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// opened in place, the frame isn't needed afterwards
+	sealed := data[aeadHeaderSize:]
+	plain, err := aead.Open(sealed[:0], aeadNonce(data[aeadSaltSize:aeadHeaderSize]),
+		sealed, data[:aeadHeaderSize])
+	if err != nil {
+		return nil, fmt.Errorf("aead: packet authentication failed")
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	// another worker may have taken a peer or seq meanwhile
+	if e.peer == nil {
+		e.peer = p
+	} else if e.peer.salt != salt {
+		return nil, fmt.Errorf("aead: packet from another sender")
+	}
+	if !e.peer.replay.fresh(seq) {
+		return nil, fmt.Errorf("aead: replayed packet %d", seq)
+	}
+	e.peer.replay.accept(seq)
+	return plain, nil
+}
+
+// peerFor checks the header of a packet and returns the peer to open it
+// with. A new peer is only taken once the packet is authentic.
+func (e *AEADEncoder) peerFor(salt [aeadSaltSize]byte, seq uint64, bound bool) (*aeadPeer, error) {
+	if e.seal == nil {
+		return nil, fmt.Errorf("aead: no key")
+	} else if salt == e.salt {
+		return nil, fmt.Errorf("aead: reflected packet")
+	} else if bound != (e.bseal != nil) {
+		return nil, fmt.Errorf("aead: packet from another handshake")
+	}
+
+	p := e.peer
+	if p == nil {
+		aead, err := aeadFor(e.key, salt, e.bound)
+		if err != nil {
+			return nil, err
+		}
+		p = &aeadPeer{salt: salt, aead: aead}
+	} else if salt != p.salt {
+		return nil, fmt.Errorf("aead: packet from another sender")
+	}
+	if !p.replay.fresh(seq) {
+		return nil, fmt.Errorf("aead: replayed packet %d", seq)
+	}
+	return p, nil
+}
+
+func init() {
+	RegisterEncoder("aead", AEADEncoder{})
+}
@@ -0,0 +1,261 @@
+package secretun
+
+import (
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator checks the credentials of a connecting client
+type Authenticator interface {
+	Init(Config) error
+	Authenticate(username, password string) (*User, error)
+}
+
+// userLookup is implemented by backends that know their users without a
+// password, which cert_login needs
+type userLookup interface {
+	Lookup(username string) (*User, error)
+}
+
+// userLister is implemented by backends that can list every user, so the
+// server can reserve pinned addresses up front
+type userLister interface {
+	Users() []*User
+}
+
+// userWatcher is implemented by backends that reload their users on their
+// own. They call pin with every new list before using it, an error keeps
+// the old one. A nil pin stops that.
+type userWatcher interface {
+	watchUsers(pin func([]*User) error)
+}
+
+var authenticators = map[string]reflect.Type{}
+
+func RegisterAuthenticator(name string, i interface{}) {
+	t := reflect.TypeOf(i)
+	if _, ok := reflect.New(t).Interface().(Authenticator); !ok {
+		panic(fmt.Errorf("invalid Authenticator: %s", name))
+	}
+	authenticators[name] = t
+}
+
+func NewAuthenticator(name string) (a Authenticator, err error) {
+	t, ok := authenticators[name]
+	if !ok {
+		err = fmt.Errorf("invalid Authenticator: %s", name)
+		return
+	}
+	return reflect.New(t).Interface().(Authenticator), nil
+}
+
+const (
+	pbkdf2Prefix = "$pbkdf2-sha256$"
+	pbkdf2Iter   = 600000
+	pbkdf2Salt   = 16
+	pbkdf2Size   = 32
+	apr1Prefix   = "$apr1$"
+	shaPrefix    = "{SHA}"
+)
+
+// HashPassword returns the users file form of password, a bcrypt hash. It
+// only works for plain logins, see HashScram.
+func HashPassword(password string) (string, error) {
+	return hashBcrypt(password, bcryptCost)
+}
+
+// HashScram returns a SCRAM-SHA-256 verifier of password, which works for
+// both plain and challenge-response logins
+func HashScram(password string) (string, error) {
+	salt := make([]byte, pbkdf2Salt)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	salted, err := scramSaltedPassword(password, salt, pbkdf2Iter)
+	if err != nil {
+		return "", err
+	}
+	return newScramCredentials(salted, salt, pbkdf2Iter).String(), nil
+}
+
+// dummyHash is checked for unknown users so they take as long as known ones
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := HashPassword("")
+	return hash
+})
+
+func isHashed(stored string) bool {
+	return strings.HasPrefix(stored, "$") || strings.HasPrefix(stored, shaPrefix)
+}
+
+// checkPassword compares password with a stored hash, or with the stored
+// password itself for old plaintext entries
+func checkPassword(stored, password string) (bool, error) {
+	var computed string
+
+	switch {
+	case strings.HasPrefix(stored, scramPrefix):
+		creds, err := parseScramCredentials(stored)
+		if err != nil {
+			return false, err
+		}
+		return creds.checkPassword(password)
+	case strings.HasPrefix(stored, pbkdf2Prefix):
+		salt, want, iter, err := parsePBKDF2(stored)
+		if err != nil {
+			return false, err
+		}
+		hash, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare(hash, want) == 1, nil
+	case strings.HasPrefix(stored, apr1Prefix):
+		salt := stored[len(apr1Prefix):]
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		computed = apr1(password, salt)
+	case strings.HasPrefix(stored, shaPrefix):
+		sum := sha1.Sum([]byte(password))
+		computed = shaPrefix + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(stored, "$2"):
+		hash, err := bcrypt(stored, password)
+		if err != nil {
+			return false, err
+		}
+		computed = hash
+	case strings.HasPrefix(stored, "$"):
+		return false, fmt.Errorf("unsupported password hash")
+	default:
+		computed = password
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(stored)) == 1, nil
+}
+
+// parsePBKDF2 reads $pbkdf2-sha256$ITERATIONS$SALT$HASH
+func parsePBKDF2(stored string) (salt, hash []byte, iter int, err error) {
+	segs := strings.Split(strings.TrimPrefix(stored, pbkdf2Prefix), "$")
+	if len(segs) != 3 {
+		err = fmt.Errorf("invalid pbkdf2 hash")
+		return
+	}
+	if iter, err = strconv.Atoi(segs[0]); err != nil || iter <= 0 {
+		err = fmt.Errorf("invalid pbkdf2 iterations")
+		return
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(segs[1]); err != nil {
+		err = fmt.Errorf("invalid pbkdf2 salt")
+		return
+	}
+	if hash, err = base64.RawStdEncoding.DecodeString(segs[2]); err != nil || len(hash) == 0 {
+		err = fmt.Errorf("invalid pbkdf2 hash")
+	}
+	return
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 is Apache's MD5 crypt, the default hash of htpasswd
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	h := md5.New()
+	h.Write([]byte(password + apr1Prefix + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	var out []byte
+	to64 := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	to64(uint(final[11]), 2)
+	return apr1Prefix + salt + "$" + string(out)
+}
+
+// watchedFile calls load again whenever path changes on disk
+type watchedFile struct {
+	path string
+	load func(path string) error
+
+	lock sync.Mutex
+	mod  time.Time
+	size int64
+}
+
+// refresh reloads a changed file. A broken file is reported once and the
+// previous contents stay in use.
+func (f *watchedFile) refresh() error {
+	st, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if st.ModTime().Equal(f.mod) && st.Size() == f.size {
+		return nil
+	}
+	reload := !f.mod.IsZero()
+	f.mod, f.size = st.ModTime(), st.Size()
+	if err := f.load(f.path); err != nil {
+		return fmt.Errorf("%s: %v", f.path, err)
+	}
+	if reload {
+		log.Println("reloaded", f.path)
+	}
+	return nil
+}
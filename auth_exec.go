@@ -0,0 +1,87 @@
+package secretun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+const authTimeout = 10
+
+// ExecAuth runs a command with "username\npassword\n" on stdin and lets
+// the user in when it exits with status 0
+type ExecAuth struct {
+	command []string
+	timeout time.Duration
+}
+
+// WebhookAuth posts {"username": ..., "password": ...} to a url and lets
+// the user in on any 2xx response
+type WebhookAuth struct {
+	url    string
+	client http.Client
+}
+
+func authTimeoutConfig(cfg Config) (time.Duration, error) {
+	timeout := authTimeout
+	if err := cfg.GetOptional("timeout", &timeout); err != nil {
+		return 0, err
+	}
+	return time.Duration(timeout) * time.Second, nil
+}
+
+func (a *ExecAuth) Init(cfg Config) (err error) {
+	if err = cfg.Get("command", &a.command); err != nil {
+		return
+	} else if len(a.command) == 0 {
+		return fmt.Errorf("auth: empty command")
+	}
+	a.timeout, err = authTimeoutConfig(cfg)
+	return
+}
+
+func (a *ExecAuth) Authenticate(username, password string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, a.command[0], a.command[1:]...)
+	cmd.Stdin = bytes.NewBufferString(username + "\n" + password + "\n")
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v", a.command[0], err)
+	}
+	return &User{Name: username}, nil
+}
+
+func (a *WebhookAuth) Init(cfg Config) (err error) {
+	if err = cfg.Get("url", &a.url); err != nil {
+		return
+	}
+	a.client.Timeout, err = authTimeoutConfig(cfg)
+	return
+}
+
+func (a *WebhookAuth) Authenticate(username, password string) (*User, error) {
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("webhook: %s", resp.Status)
+	}
+	return &User{Name: username}, nil
+}
+
+func init() {
+	RegisterAuthenticator("exec", ExecAuth{})
+	RegisterAuthenticator("webhook", WebhookAuth{})
+}
@@ -0,0 +1,228 @@
+package secretun
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// FileAuth checks users against a users file, see parseUser. Passwords are
+// hashed with HashPassword or HashScram, plaintext entries still work but
+// are reported.
+type FileAuth struct {
+	file  watchedFile
+	lock  sync.RWMutex
+	users map[string]*User
+	list  []*User
+	pin   func([]*User) error
+}
+
+// HtpasswdAuth checks users against an Apache htpasswd file
+type HtpasswdAuth struct {
+	file   watchedFile
+	lock   sync.RWMutex
+	hashes map[string]string
+}
+
+func (a *FileAuth) Init(cfg Config) error {
+	a.file.load = a.load
+	if err := cfg.Get("path", &a.file.path); err != nil {
+		return err
+	}
+	return a.file.refresh()
+}
+
+func (a *FileAuth) load(path string) error {
+	list, err := readUsers(path)
+	if err != nil {
+		return err
+	}
+
+	users := map[string]*User{}
+	plain := 0
+	for _, u := range list {
+		if _, ok := users[u.Name]; ok {
+			return fmt.Errorf("duplicate user %s", u.Name)
+		}
+		users[u.Name] = u
+		if u.Password != noPassword && !isHashed(u.Password) {
+			plain++
+		}
+	}
+	if plain > 0 {
+		log.Printf("%s: %d plaintext passwords, hash them with passwd", path, plain)
+	}
+
+	a.lock.RLock()
+	pin := a.pin
+	a.lock.RUnlock()
+	if pin != nil {
+		if err := pin(list); err != nil {
+			return err
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.users, a.list = users, list
+	return nil
+}
+
+func (a *FileAuth) watchUsers(pin func([]*User) error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.pin = pin
+}
+
+func (a *FileAuth) user(username string) *User {
+	if err := a.file.refresh(); err != nil {
+		log.Println(err)
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.users[username]
+}
+
+func (a *FileAuth) Authenticate(username, password string) (*User, error) {
+	u := a.user(username)
+	if u == nil {
+		checkPassword(dummyHash(), password)
+		return nil, fmt.Errorf("unknown user")
+	} else if u.Password == noPassword {
+		return nil, fmt.Errorf("password login disabled")
+	}
+
+	if ok, err := checkPassword(u.Password, password); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("wrong password")
+	}
+	return u, nil
+}
+
+func (a *FileAuth) ScramCredentials(username string) (*User, *scramCredentials, error) {
+	u := a.user(username)
+	if u == nil {
+		return nil, nil, fmt.Errorf("unknown user")
+	}
+
+	switch {
+	case u.Password == noPassword:
+		return nil, nil, fmt.Errorf("password login disabled")
+	case strings.HasPrefix(u.Password, scramPrefix):
+		creds, err := parseScramCredentials(u.Password)
+		return u, creds, err
+	case strings.HasPrefix(u.Password, pbkdf2Prefix):
+		salt, hash, iter, err := parsePBKDF2(u.Password)
+		if err != nil {
+			return nil, nil, err
+		} else if len(hash) != sha256.Size {
+			return nil, nil, fmt.Errorf("pbkdf2 hash is not %s compatible", scramMechanism)
+		}
+		return u, newScramCredentials(hash, salt, iter), nil
+	case isHashed(u.Password):
+		return nil, nil, fmt.Errorf("password hash is not %s compatible", scramMechanism)
+	}
+
+	// plaintext, the salt only has to stay the same for this user
+	salt := sha256.Sum256([]byte("secretun scram " + u.Name))
+	salted, err := scramSaltedPassword(u.Password, salt[:pbkdf2Salt], scramPlainIter)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, newScramCredentials(salted, salt[:pbkdf2Salt], scramPlainIter), nil
+}
+
+func (a *FileAuth) Lookup(username string) (*User, error) {
+	if u := a.user(username); u != nil {
+		return u, nil
+	}
+	return nil, fmt.Errorf("unknown user")
+}
+
+func (a *FileAuth) Users() []*User {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.list
+}
+
+func (a *HtpasswdAuth) Init(cfg Config) error {
+	a.file.load = a.load
+	if err := cfg.Get("path", &a.file.path); err != nil {
+		return err
+	}
+	return a.file.refresh()
+}
+
+func (a *HtpasswdAuth) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hashes := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid htpasswd line: %q", line)
+		}
+		hashes[kv[0]] = kv[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.hashes = hashes
+	return nil
+}
+
+func (a *HtpasswdAuth) hash(username string) (string, bool) {
+	if err := a.file.refresh(); err != nil {
+		log.Println(err)
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	hash, ok := a.hashes[username]
+	return hash, ok
+}
+
+func (a *HtpasswdAuth) Authenticate(username, password string) (*User, error) {
+	hash, ok := a.hash(username)
+	if !ok {
+		checkPassword(dummyHash(), password)
+		return nil, fmt.Errorf("unknown user")
+	}
+
+	if ok, err := checkPassword(hash, password); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("wrong password")
+	}
+	return &User{Name: username}, nil
+}
+
+func (a *HtpasswdAuth) Lookup(username string) (*User, error) {
+	if _, ok := a.hash(username); ok {
+		return &User{Name: username}, nil
+	}
+	return nil, fmt.Errorf("unknown user")
+}
+
+func init() {
+	RegisterAuthenticator("file", FileAuth{})
+	RegisterAuthenticator("htpasswd", HtpasswdAuth{})
+}
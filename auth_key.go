@@ -0,0 +1,177 @@
+package secretun
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Key login works like ssh's authorized_keys. The client names its ed25519
+// public key in AuthInfo, the server answers with a nonce in a
+// PT_CHALLENGE and the client signs it in an AuthProof.
+
+const (
+	keyMechanism = "ed25519"
+	keyAuthLabel = "secretun key auth v1"
+	keyNonceSize = 32
+)
+
+// authorizedKeys maps public keys to the users they log in as, one
+//
+//	PUBLICKEY USERNAME
+//
+// per line, a key listed for several users needs the client to name one
+type authorizedKeys struct {
+	file watchedFile
+	lock sync.RWMutex
+	keys map[string][]string
+}
+
+func newAuthorizedKeys(path string) (*authorizedKeys, error) {
+	k := &authorizedKeys{}
+	k.file.path, k.file.load = path, k.load
+	return k, k.file.refresh()
+}
+
+func (k *authorizedKeys) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keys := map[string][]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		segs := strings.Fields(line)
+		if len(segs) != 2 {
+			return fmt.Errorf("invalid authorized key line: %q", line)
+		}
+		if _, err := parsePublicKey(segs[0]); err != nil {
+			return fmt.Errorf("user %s: %v", segs[1], err)
+		}
+		keys[segs[0]] = append(keys[segs[0]], segs[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.keys = keys
+	return nil
+}
+
+// user returns who pub logs in as, username may be empty if the key is
+// only listed once
+func (k *authorizedKeys) user(pub []byte, username string) (string, error) {
+	if err := k.file.refresh(); err != nil {
+		log.Println(err)
+	}
+
+	k.lock.RLock()
+	names := k.keys[base64.StdEncoding.EncodeToString(pub)]
+	k.lock.RUnlock()
+
+	switch {
+	case len(names) == 0:
+		return "", fmt.Errorf("unknown key")
+	case len(username) == 0 && len(names) == 1:
+		return names[0], nil
+	case len(username) == 0:
+		return "", fmt.Errorf("key is listed for several users, the client has to set username")
+	}
+	for _, name := range names {
+		if name == username {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("key is not authorized for %s", username)
+}
+
+func keyTranscript(username string, pub []byte, nonce string) []byte {
+	t := []byte(keyAuthLabel + "\x00" + username + "\x00")
+	t = append(t, pub...)
+	return append(t, nonce...)
+}
+
+// clientKeyAuth is the client half, it signs the server's nonce with key
+func clientKeyAuth(cli_ch *ClientChan, info AuthInfo, key ed25519.PrivateKey) (*AuthResult, error) {
+	var ch AuthChallenge
+
+	info.Mechanism = keyMechanism
+	info.PublicKey = key.Public().(ed25519.PublicKey)
+	cli_ch.W <- NewPacket(PT_AUTH, &info)
+
+	if rst, err := recvChallenge(cli_ch, &ch); rst != nil || err != nil {
+		return rst, err
+	}
+	if len(ch.Nonce) == 0 {
+		return nil, fmt.Errorf("auth challenge without nonce")
+	}
+
+	sig := ed25519.Sign(key, keyTranscript(info.Username, info.PublicKey, ch.Nonce))
+	cli_ch.W <- NewPacket(PT_AUTH, &AuthProof{sig})
+	return recvAuthResult(cli_ch)
+}
+
+// keyChallenge is the server half, it returns the user, or nil if the key
+// or the signature is wrong
+func (c *serverConfig) keyChallenge(cli_ch *ClientChan, info *AuthInfo) (*User, error) {
+	if c.authorized == nil {
+		return nil, fmt.Errorf("key login not configured")
+	}
+	if len(info.PublicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key")
+	}
+
+	name, err := c.authorized.user(info.PublicKey, info.Username)
+	if err != nil {
+		log.Printf("key login as %q: %v", info.Username, err)
+		return nil, nil
+	}
+	name, ok := userName(&AuthInfo{Username: name}, cli_ch.Identity)
+	if !ok {
+		return nil, nil
+	}
+
+	nonce := make([]byte, keyNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ch := AuthChallenge{Nonce: base64.StdEncoding.EncodeToString(nonce)}
+	cli_ch.W <- NewPacket(PT_CHALLENGE, &ch)
+
+	var proof AuthProof
+	p, err := cli_ch.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if p.Type != PT_AUTH {
+		return nil, fmt.Errorf("key login: expected the proof, got packet type %d", p.Type)
+	}
+	if p.Decode(&proof) != nil {
+		return nil, fmt.Errorf("key login: invalid proof")
+	}
+	if !ed25519.Verify(info.PublicKey, keyTranscript(info.Username, info.PublicKey, ch.Nonce), proof.Proof) {
+		log.Printf("user %s: bad key signature", name)
+		return nil, nil
+	}
+
+	user, err := c.lookupUser(name)
+	if err != nil {
+		log.Printf("user %s: %v", name, err)
+		return nil, nil
+	}
+	return user, nil
+}
@@ -0,0 +1,194 @@
+package secretun
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strconv"
+	"sync"
+)
+
+// bcrypt hashes, $2a$, $2b$ or $2y$, COST$ then 22 characters of salt and
+// 31 of hash, as written by htpasswd -B and most other tools. HashPassword
+// writes them too, but challenge-response logins need SCRAM verifiers.
+
+const (
+	bcryptSaltLen = 22
+	bcryptHashLen = 31
+	bcryptMinCost = 4
+	bcryptMaxCost = 31
+	bcryptCost    = 10
+	// the key stops at 72 bytes, the rest of a longer password is ignored
+	bcryptMaxPassword = 72
+)
+
+var bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").
+	WithPadding(base64.NoPadding)
+
+// the digits of pi are the initial blowfish state, P then the four s-boxes
+type blowfish struct {
+	p [18]uint32
+	s [4][256]uint32
+}
+
+// blowfishPi holds the first 18+4*256 words of the fraction of pi, computed
+// once rather than carried as a table
+var blowfishPi = sync.OnceValue(func() *blowfish {
+	words := 18 + 4*256
+	bits := uint(words*32 + 64)
+
+	// pi = 16 atan(1/5) - 4 atan(1/239), in fixed point with bits fraction bits
+	atan := func(x int64) *big.Int {
+		sum := new(big.Int)
+		xx := big.NewInt(x * x)
+		power := new(big.Int).Lsh(big.NewInt(1), bits)
+		power.Quo(power, big.NewInt(x))
+		term := new(big.Int)
+		for k := int64(0); power.Sign() != 0; k++ {
+			term.Quo(power, big.NewInt(2*k+1))
+			if k%2 == 0 {
+				sum.Add(sum, term)
+			} else {
+				sum.Sub(sum, term)
+			}
+			power.Quo(power, xx)
+		}
+		return sum
+	}
+	pi := atan(5)
+	pi.Lsh(pi, 4)
+	pi.Sub(pi, new(big.Int).Lsh(atan(239), 2))
+
+	// drop the guard bits and the integer part
+	frac := pi.Rsh(pi, 64).Bytes()[1:]
+	b := new(blowfish)
+	for i := range b.p {
+		b.p[i] = binary.BigEndian.Uint32(frac[4*i:])
+	}
+	frac = frac[4*len(b.p):]
+	for i := range b.s {
+		for j := range b.s[i] {
+			b.s[i][j] = binary.BigEndian.Uint32(frac[4*(256*i+j):])
+		}
+	}
+	return b
+})
+
+func (b *blowfish) f(x uint32) uint32 {
+	return ((b.s[0][x>>24] + b.s[1][x>>16&0xff]) ^ b.s[2][x>>8&0xff]) + b.s[3][x&0xff]
+}
+
+func (b *blowfish) encrypt(l, r uint32) (uint32, uint32) {
+	l ^= b.p[0]
+	for i := 1; i < 17; i += 2 {
+		r ^= b.f(l) ^ b.p[i]
+		l ^= b.f(r) ^ b.p[i+1]
+	}
+	return r ^ b.p[17], l
+}
+
+// streamWord reads the next big endian word of data, wrapping around
+func streamWord(data []byte, pos *int) uint32 {
+	var w uint32
+	for i := 0; i < 4; i++ {
+		w = w<<8 | uint32(data[*pos])
+		*pos = (*pos + 1) % len(data)
+	}
+	return w
+}
+
+// expand is the eksblowfish key schedule, salt is nil for the expensive
+// rounds which only mix in the key
+func (b *blowfish) expand(key, salt []byte) {
+	pos := 0
+	for i := range b.p {
+		b.p[i] ^= streamWord(key, &pos)
+	}
+
+	var l, r uint32
+	spos := 0
+	next := func() {
+		if salt != nil {
+			l ^= streamWord(salt, &spos)
+			r ^= streamWord(salt, &spos)
+		}
+		l, r = b.encrypt(l, r)
+	}
+	for i := 0; i < len(b.p); i += 2 {
+		next()
+		b.p[i], b.p[i+1] = l, r
+	}
+	for i := range b.s {
+		for j := 0; j < len(b.s[i]); j += 2 {
+			next()
+			b.s[i][j], b.s[i][j+1] = l, r
+		}
+	}
+}
+
+// hashBcrypt hashes password with a fresh salt. It refuses passwords bcrypt
+// would cut short.
+func hashBcrypt(password string, cost int) (string, error) {
+	if len(password) > bcryptMaxPassword {
+		return "", fmt.Errorf("bcrypt: password longer than %d bytes", bcryptMaxPassword)
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return bcrypt(fmt.Sprintf("$2b$%02d$%s", cost, bcryptEncoding.EncodeToString(salt)), password)
+}
+
+// bcrypt returns the hash of password in the form of stored, which gives
+// the variant, cost and salt
+func bcrypt(stored, password string) (string, error) {
+	if len(stored) < 7 || stored[0] != '$' || stored[1] != '2' || stored[3] != '$' || stored[6] != '$' {
+		return "", fmt.Errorf("invalid bcrypt hash")
+	}
+	switch stored[2] {
+	case 'a', 'b', 'y':
+	default:
+		// $2x$ is the output of a long fixed sign extension bug
+		return "", fmt.Errorf("unsupported bcrypt variant $2%c$", stored[2])
+	}
+	cost, err := strconv.Atoi(stored[4:6])
+	if err != nil || cost < bcryptMinCost || cost > bcryptMaxCost {
+		return "", fmt.Errorf("invalid bcrypt cost")
+	}
+	prefix := stored[:7]
+	if len(stored) < len(prefix)+bcryptSaltLen {
+		return "", fmt.Errorf("invalid bcrypt salt")
+	}
+	encoded_salt := stored[len(prefix) : len(prefix)+bcryptSaltLen]
+	salt, err := bcryptEncoding.DecodeString(encoded_salt)
+	if err != nil {
+		return "", fmt.Errorf("invalid bcrypt salt")
+	}
+
+	// the key includes the trailing NUL
+	key := append([]byte(password), 0)
+	if len(key) > bcryptMaxPassword {
+		key = key[:bcryptMaxPassword]
+	}
+
+	b := *blowfishPi()
+	b.expand(key, salt)
+	for i := uint64(0); i < 1<<cost; i++ {
+		b.expand(key, nil)
+		b.expand(salt, nil)
+	}
+
+	text := []byte("OrpheanBeholderScryDoubt")
+	for i := 0; i < len(text); i += 8 {
+		l := binary.BigEndian.Uint32(text[i:])
+		r := binary.BigEndian.Uint32(text[i+4:])
+		for j := 0; j < 64; j++ {
+			l, r = b.encrypt(l, r)
+		}
+		binary.BigEndian.PutUint32(text[i:], l)
+		binary.BigEndian.PutUint32(text[i+4:], r)
+	}
+	return prefix + encoded_salt + bcryptEncoding.EncodeToString(text[:23]), nil
+}
@@ -0,0 +1,77 @@
+package secretun
+
+import (
+	"strings"
+	"testing"
+)
+
+// from the OpenBSD regress tests and the crypt_blowfish test suite
+var bcryptVectors = []struct {
+	password string
+	hash     string
+}{
+	{"", "$2a$06$DCq7YPn5Rq63x1Lad4cll.TV4S6ytwfsfvkgY8jIucDrjc8deX1s."},
+	{"a", "$2a$06$m0CrhHm10qJ3lXRY.5zDGO3rS2KdeeWLuGmsfGlMfOxih58VYVfxe"},
+	{"abc", "$2a$06$If6bvum7DFjUnE9p2uDeDu0YHzrHM6tf.iqN8.yx.jNN1ILEf7h0i"},
+	{"abcdefghijklmnopqrstuvwxyz", "$2a$06$.rCVZVOThsIa97pEDOxvGuRRgzG64bvtJ0938xuqzv18d3ZpQhstC"},
+	{"~!@#$%^&*()      ~!@#$%^&*()PNBFRD", "$2a$06$fPIsBO8qRqkjj273rfaOI.HtSV9jLDpTbZn782DC6/t7qT67P6FfO"},
+	{"U*U", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+	{"U*U*", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.VGOzA784oUp/Z0DY336zx7pLYAy0lwK"},
+	{"U*U*U", "$2a$05$XXXXXXXXXXXXXXXXXXXXXOAcXxm9kjPGEMsLznoKqmqw7tc8WCx4a"},
+	{"", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.7uG0VCzI2bS7j6ymqJi9CdcdxiRTWNy"},
+	{"0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789chars after 72 are ignored",
+		"$2a$05$abcdefghijklmnopqrstuu5s2v8.iXieOjg/.AySBTTZIIVFJeBui"},
+	{"\xa3", "$2b$05$/OK.fbVrR/bpIqNJ5ianF.Sa7shbm4.OzKpvFnX1pQLmQW96oUlCq"},
+	{"\xff\xff\xa3", "$2b$05$/OK.fbVrR/bpIqNJ5ianF.CE5elHaaO4EbggVDjb8P19RukzXSM3e"},
+	{"\xff\xff\xa3", "$2y$05$/OK.fbVrR/bpIqNJ5ianF.CE5elHaaO4EbggVDjb8P19RukzXSM3e"},
+}
+
+func TestBcrypt(t *testing.T) {
+	for _, v := range bcryptVectors {
+		hash, err := bcrypt(v.hash, v.password)
+		if err != nil {
+			t.Errorf("%s: %v", v.hash, err)
+		} else if hash != v.hash {
+			t.Errorf("%q: got %s, want %s", v.password, hash, v.hash)
+		}
+		if len(v.password) < 72 {
+			if ok, _ := checkPassword(v.hash, v.password+"x"); ok {
+				t.Errorf("%s: wrong password accepted", v.hash)
+			}
+		}
+	}
+}
+
+func TestBcryptInvalid(t *testing.T) {
+	for _, hash := range []string{
+		"$2x$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$2a$03$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$2a$32$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$2a$05$CCCCCCCCCC",
+		"$2a$05$CCCCCCCCCCCCCCCCCCCC!!E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$2a05$",
+	} {
+		if _, err := bcrypt(hash, "U*U"); err == nil {
+			t.Errorf("%s: no error", hash)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$2b$10$") || len(hash) != 60 {
+		t.Fatalf("unexpected hash %s", hash)
+	}
+	if ok, err := checkPassword(hash, "secret"); !ok || err != nil {
+		t.Errorf("password not accepted: %v", err)
+	}
+	if ok, _ := checkPassword(hash, "Secret"); ok {
+		t.Errorf("wrong password accepted")
+	}
+	if _, err := HashPassword(strings.Repeat("x", 73)); err == nil {
+		t.Errorf("password over 72 bytes hashed")
+	}
+}
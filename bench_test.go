@@ -0,0 +1,174 @@
+package secretun
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// The data path on its own, without a tun device or a real network:
+// packets go from one packetTunnel to another over a loopback tcp
+// connection, e.g.
+//
+//	go test -run - -bench DataPath -benchmem
+
+var benchSizes = []int{64, 512, 1400}
+
+func benchConfigs(b *testing.B) []struct {
+	name string
+	cfg  map[string]interface{}
+} {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		b.Fatal(err)
+	}
+	encoder := func(name string) map[string]interface{} {
+		return map[string]interface{}{
+			"encoders": []interface{}{map[string]interface{}{"name": name}},
+		}
+	}
+	return []struct {
+		name string
+		cfg  map[string]interface{}
+	}{
+		{"plain", map[string]interface{}{"encoders": []interface{}{}}},
+		{"key", map[string]interface{}{
+			"encoders": []interface{}{},
+			"key":      base64.StdEncoding.EncodeToString(key),
+		}},
+		{"zlib", encoder("zlib")},
+		{"deflate", encoder("deflate")},
+		{"snappy", encoder("snappy")},
+	}
+}
+
+// BenchmarkDataPath is the path as it is: pooled buffers with headroom,
+// encoded in place and written in batches
+func BenchmarkDataPath(b *testing.B) {
+	benchDataPath(b, func(c frameConn) frameConn { return c }, getPacket)
+}
+
+// BenchmarkDataPathUnbatched writes every frame with a system call of its
+// own, as packetTunnel did before batching
+func BenchmarkDataPathUnbatched(b *testing.B) {
+	benchDataPath(b, func(c frameConn) frameConn { return unbatchedConn{c} }, getPacket)
+}
+
+// BenchmarkDataPathCopied gives every packet a buffer of its own without
+// headroom, as Tun.ReadChan did before the pool, so each frame is copied
+// out and the buffer left to the garbage collector
+func BenchmarkDataPathCopied(b *testing.B) {
+	benchDataPath(b, func(c frameConn) frameConn { return unbatchedConn{c} }, func(size int) *Packet {
+		return &Packet{Type: PT_P2P, Data: make([]byte, size)}
+	})
+}
+
+type unbatchedConn struct {
+	frameConn
+}
+
+func (c unbatchedConn) WriteFrames(frames [][]byte) error {
+	for _, frame := range frames {
+		if err := c.frameConn.WriteFrames([][]byte{frame}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func benchDataPath(b *testing.B, wrap func(frameConn) frameConn, packet func(int) *Packet) {
+	for _, c := range benchConfigs(b) {
+		for _, size := range benchSizes {
+			b.Run(fmt.Sprintf("%s/%d", c.name, size), func(b *testing.B) {
+				pc, err := newPacketConfig(Config{Map: c.cfg, Name: "packet"})
+				if err != nil {
+					b.Fatal(err)
+				}
+				src, dst, err := benchTunnels(pc, wrap)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer dst.Close()
+				defer src.Close()
+
+				payload := make([]byte, size)
+				if _, err := rand.Read(payload); err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				n := b.N
+				go func() {
+					// as the tun reader would hand them out
+					for i := 0; i < n; i++ {
+						p := packet(size)
+						copy(p.Data, payload)
+						select {
+						case src.W <- p:
+						case <-src.Done:
+							return
+						}
+					}
+				}()
+				for i := 0; i < n; i++ {
+					p, err := dst.Recv()
+					if err != nil {
+						b.Fatal(err)
+					}
+					p.Release()
+				}
+			})
+		}
+	}
+}
+
+// benchTunnels connects two ClientChans as a client and server would after
+// the handshake
+func benchTunnels(pc *packetConfig, wrap func(frameConn) frameConn) (src, dst ClientChan, err error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return
+	}
+	server := <-accepted
+	if server == nil {
+		client.Close()
+		return src, dst, net.ErrClosed
+	}
+
+	src, dst = NewClientChan(), NewClientChan()
+	for _, end := range []struct {
+		cli_ch ClientChan
+		conn   net.Conn
+	}{{src, client}, {dst, server}} {
+		packetTunnel(wrap(newStreamConn(end.conn)), end.cli_ch)
+
+		psk, err := pc.seal()
+		if err != nil {
+			return src, dst, err
+		}
+		end.cli_ch.codec.start(psk, pc.workers)
+		encoders, err := pc.build(pc.names)
+		if err != nil {
+			return src, dst, err
+		}
+		if err := end.cli_ch.codec.setEncoders(encoders); err != nil {
+			return src, dst, err
+		}
+	}
+	return
+}
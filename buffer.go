@@ -0,0 +1,61 @@
+package secretun
+
+import "sync"
+
+// Data packets travel in pooled buffers from the tun to the wire and back.
+// An IP packet read from the tun sits packetHeadroom bytes into its buffer,
+// so the packet type, the seal and the frame and transport headers can be
+// put in front of it without copying, and the packetTailroom bytes behind
+// it take the AEAD tag.
+const (
+	packetHeadroom = 64
+	packetTailroom = aeadTagSize
+
+	// most packets fit the small buffers, the large ones take the biggest
+	// IP packet a tun hands out
+	smallBuffer = 4096
+	largeBuffer = packetHeadroom + 65535 + packetTailroom
+
+	// packetQueueSize is how many packets may wait between two stages of
+	// the data path, maxBatch how many of them a writer takes at once
+	packetQueueSize = 64
+	maxBatch        = 64
+)
+
+var (
+	smallBuffers = sync.Pool{New: func() interface{} { return new([smallBuffer]byte) }}
+	largeBuffers = sync.Pool{New: func() interface{} { return new([largeBuffer]byte) }}
+)
+
+// getBuffer returns a buffer of size bytes, pooled unless it is larger
+// than largeBuffer
+func getBuffer(size int) []byte {
+	switch {
+	case size <= smallBuffer:
+		return smallBuffers.Get().(*[smallBuffer]byte)[:size]
+	case size <= largeBuffer:
+		return largeBuffers.Get().(*[largeBuffer]byte)[:size]
+	}
+	return make([]byte, size)
+}
+
+// putBuffer hands a buffer from getBuffer back, nobody may use it after
+func putBuffer(buf []byte) {
+	switch cap(buf) {
+	case smallBuffer:
+		smallBuffers.Put((*[smallBuffer]byte)(buf[:smallBuffer]))
+	case largeBuffer:
+		largeBuffers.Put((*[largeBuffer]byte)(buf[:largeBuffer]))
+	}
+}
+
+// getPacket returns a PT_P2P packet with room for size bytes of data in a
+// pooled buffer, Release gives the buffer back
+func getPacket(size int) *Packet {
+	buf := getBuffer(packetHeadroom + size + packetTailroom)
+	return &Packet{
+		Type: PT_P2P,
+		Data: buf[packetHeadroom : packetHeadroom+size],
+		buf:  buf,
+	}
+}
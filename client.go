@@ -1,13 +1,47 @@
 package secretun
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"log"
+	"math/rand/v2"
+	"net"
+	"time"
 )
 
+// authConfig depends on the login, a password, Key_file or none at all
+// when the tls certificate is the login
 type authConfig struct {
-	Username string
-	Password string
+	Username   string `config:"optional"`
+	Password   string `config:"optional"`
+	Server_key string `config:"optional"`
+	Mechanism  string `config:"optional"`
+	Key_file   string `config:"optional"`
+}
+
+// reconnectConfig is how long to wait before dialing again after the
+// connection dropped, doubling up to Max_delay. Attempts 0 retries forever.
+type reconnectConfig struct {
+	Delay     int `config:"optional"`
+	Max_delay int `config:"optional"`
+	Attempts  int `config:"optional"`
+}
+
+// tunConfig is the optional "tun" section, Queues opens the device with
+// that many queues
+type tunConfig struct {
+	Queues int `config:"optional"`
+}
+
+// loginTimeout bounds the whole login, datagram tunnels never tell us the
+// server is gone
+const loginTimeout = 15 * time.Second
+
+// authRefused is a login the server turned down, dialing again won't help
+type authRefused string
+
+func (e authRefused) Error() string {
+	return "auth fail: " + string(e)
 }
 
 type Client struct {
@@ -15,9 +49,18 @@ type Client struct {
 	tunnel   ClientTunnel
 	cli_ch   ClientChan
 	nat_info NatInfo
+	kex_key  ed25519.PublicKey
+	key      ed25519.PrivateKey
 
-	auth_cfg   authConfig
-	tunnel_cfg Config
+	auth_cfg      authConfig
+	reconnect_cfg reconnectConfig
+	tun_cfg       tunConfig
+	tunnel_name   string
+	tunnel_cfg    Config
+	packet        *packetConfig
+	token         []byte
+	alive         *keepalive
+	quit          chan struct{}
 }
 
 func NewClient(cfg Config) (cli Client, err error) {
@@ -25,25 +68,70 @@ func NewClient(cfg Config) (cli Client, err error) {
 	if pkg_cfg, e := cfg.GetConfig("packet"); e != nil {
 		err = e
 		return
-	} else if err = InitPacket(pkg_cfg); err != nil {
+	} else if cli.packet, err = newPacketConfig(pkg_cfg); err != nil {
 		return
 	}
 
 	if err = cfg.Get("auth", &cli.auth_cfg); err != nil {
 		return
 	}
+	if len(cli.auth_cfg.Server_key) > 0 {
+		if cli.kex_key, err = parseServerKey(cli.auth_cfg.Server_key); err != nil {
+			return
+		}
+	}
+	if len(cli.auth_cfg.Key_file) > 0 {
+		if cli.key, err = loadPrivateKey(cli.auth_cfg.Key_file); err != nil {
+			return
+		}
+		if len(cli.auth_cfg.Mechanism) == 0 {
+			cli.auth_cfg.Mechanism = keyMechanism
+		}
+	}
+	switch cli.auth_cfg.Mechanism {
+	case "", "password", scramMechanism:
+	case keyMechanism:
+		if cli.key == nil {
+			err = fmt.Errorf("auth: %s login needs key_file", keyMechanism)
+			return
+		}
+	default:
+		err = fmt.Errorf("unsupported auth mechanism %q", cli.auth_cfg.Mechanism)
+		return
+	}
 
-	var tunnel_name string
-	if cli.tunnel_cfg, err = cfg.GetConfig("tunnel"); err != nil {
+	cli.reconnect_cfg = reconnectConfig{Delay: 1, Max_delay: 60}
+	if err = cfg.GetOptional("reconnect", &cli.reconnect_cfg); err != nil {
 		return
-	} else if err = cli.tunnel_cfg.Get("name", &tunnel_name); err != nil {
+	} else if cli.reconnect_cfg.Delay <= 0 || cli.reconnect_cfg.Max_delay < cli.reconnect_cfg.Delay {
+		err = fmt.Errorf("reconnect: invalid delay")
 		return
 	}
-	if cli.tunnel, err = NewClientTunnel(tunnel_name); err != nil {
+
+	cli.tun_cfg = tunConfig{Queues: 1}
+	if err = cfg.GetOptional("tun", &cli.tun_cfg); err != nil {
+		return
+	} else if cli.tun_cfg.Queues < 1 {
+		err = fmt.Errorf("tun: queues must be at least 1")
 		return
 	}
 
-	cli.cli_ch = NewClientChan()
+	var kc keepaliveConfig
+	if kc, err = newKeepaliveConfig(cfg); err != nil {
+		return
+	}
+	cli.alive = newKeepalive(kc)
+	cli.quit = make(chan struct{})
+
+	if cli.tunnel_cfg, err = cfg.GetConfig("tunnel"); err != nil {
+		return
+	} else if err = cli.tunnel_cfg.Get("name", &cli.tunnel_name); err != nil {
+		return
+	}
+	if cli.tunnel, err = NewClientTunnel(cli.tunnel_name); err != nil {
+		return
+	}
+	err = cli.packet.checkTunnel(cli.tunnel)
 
 	return
 }
@@ -53,71 +141,295 @@ func (c *Client) Init() error {
 }
 
 func (c *Client) Run() error {
-	defer c.cli_ch.Close()
+	defer c.hangup()
+	defer c.alive.Stop()
 
 	log.Println("client running")
 
-	if err := c.tunnel.Start(c.cli_ch); err != nil {
+	if err := recoverDNS(); err != nil {
+		log.Println(err)
+	}
+	if err := c.connect(); err != nil {
 		return err
 	}
-	if err := c.auth(); err != nil {
+	return c.nat()
+}
+
+// RTT is the round trip time to the server measured by the last ping
+func (c *Client) RTT() time.Duration {
+	return c.alive.RTT()
+}
+
+// connect starts c.tunnel and logs in over it
+func (c *Client) connect() error {
+	c.cli_ch = NewClientChan()
+
+	seal, err := c.packet.seal()
+	if err != nil {
+		c.tunnel.Shutdown()
 		return err
 	}
+	c.cli_ch.codec.start(seal, c.packet.workers)
 
-	return c.nat()
+	if err := c.tunnel.Start(c.cli_ch); err != nil {
+		c.tunnel.Shutdown()
+		return err
+	}
+
+	cli_ch := c.cli_ch
+	timer := time.AfterFunc(loginTimeout, func() {
+		cli_ch.fail(fmt.Errorf("no answer from server"))
+	})
+	defer timer.Stop()
+	return c.auth()
 }
 
+// hangup closes the current connection, if any
+func (c *Client) hangup() {
+	if c.cli_ch.Done != nil {
+		c.cli_ch.CloseWait(flushTimeout)
+		c.cli_ch = ClientChan{}
+	}
+}
+
+// redial connects with a new tunnel, resuming the session if the server
+// still has it and logging in again otherwise
+func (c *Client) redial() (err error) {
+	if c.tunnel, err = NewClientTunnel(c.tunnel_name); err != nil {
+		return
+	} else if err = c.tunnel.Init(c.tunnel_cfg); err != nil {
+		return
+	}
+	if err = c.connect(); err == nil {
+		return
+	}
+	c.hangup()
+
+	if _, ok := err.(authRefused); ok && c.token != nil {
+		log.Println("resume:", err)
+		c.token = nil
+		return c.redial()
+	}
+	return
+}
+
+// reconnect calls redial with exponential backoff until it works, the
+// server refuses the login, the attempts run out or we shut down
+func (c *Client) reconnect() error {
+	delay := time.Duration(c.reconnect_cfg.Delay) * time.Second
+	max_delay := time.Duration(c.reconnect_cfg.Max_delay) * time.Second
+
+	for attempt := 1; ; attempt++ {
+		// jitter keeps clients of a restarted server from coming back at once
+		wait := delay + rand.N(delay/2+1)
+		log.Printf("reconnecting in %v", wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-c.quit:
+			return errShutdown
+		}
+
+		err := c.redial()
+		if err == nil {
+			return nil
+		} else if _, ok := err.(authRefused); ok {
+			return err
+		}
+		log.Println("reconnect:", err)
+		if c.reconnect_cfg.Attempts > 0 && attempt >= c.reconnect_cfg.Attempts {
+			return fmt.Errorf("giving up after %d attempts", attempt)
+		}
+		delay = min(delay*2, max_delay)
+	}
+}
+
+// Shutdown makes Run say goodbye to the server and return instead of
+// reconnecting
 func (c *Client) Shutdown() error {
+	select {
+	case <-c.quit:
+	default:
+		close(c.quit)
+	}
 	return nil
 }
 
-func (c *Client) auth() error {
+// passwordAuth sends the password itself, only safe over a verified tls
+func (c *Client) passwordAuth(info AuthInfo) (*AuthResult, error) {
+	c.cli_ch.W <- NewPacket(PT_AUTH, &info)
+	return recvAuthResult(&c.cli_ch)
+}
+
+// recvAuthResult reads the AuthResult that ends every login
+func recvAuthResult(cli_ch *ClientChan) (*AuthResult, error) {
 	var rst AuthResult
 
-	p := NewPacket(PT_AUTH, &AuthInfo{c.auth_cfg.Username, c.auth_cfg.Password})
-	c.cli_ch.W <- p
-	p = <-c.cli_ch.R
-	if p.Decode(&rst) != nil {
-		return fmt.Errorf("invalid auth result")
+	p, err := cli_ch.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if p.Type != PT_AUTH || p.Decode(&rst) != nil {
+		return nil, fmt.Errorf("invalid auth result")
+	}
+	return &rst, nil
+}
+
+// recvChallenge reads the challenge of a multi-step login, or the
+// AuthResult of a server that refused it straight away
+func recvChallenge(cli_ch *ClientChan, ch *AuthChallenge) (*AuthResult, error) {
+	p, err := cli_ch.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if p.Type == PT_AUTH {
+		var rst AuthResult
+		if p.Decode(&rst) != nil {
+			return nil, fmt.Errorf("invalid auth result")
+		}
+		return &rst, nil
+	}
+	if p.Type != PT_CHALLENGE || p.Decode(ch) != nil {
+		return nil, fmt.Errorf("invalid auth challenge")
+	}
+	return nil, nil
+}
+
+func (c *Client) auth() error {
+	var rst *AuthResult
+	var err error
+
+	if err := clientHello(&c.cli_ch); err != nil {
+		return err
+	}
+	if c.kex_key != nil {
+		if err := clientKex(&c.cli_ch, c.kex_key); err != nil {
+			return err
+		}
+	}
+
+	info := AuthInfo{Username: c.auth_cfg.Username, Encoders: c.packet.offers()}
+	switch {
+	case c.token != nil && c.cli_ch.codec.feature(featureResume):
+		info.ResumeToken = c.token
+		rst, err = c.passwordAuth(info)
+	case c.auth_cfg.Mechanism == keyMechanism:
+		rst, err = clientKeyAuth(&c.cli_ch, info, c.key)
+	case c.auth_cfg.Mechanism == scramMechanism:
+		rst, err = clientScram(&c.cli_ch, info, c.auth_cfg.Password)
+	default:
+		info.Password = c.auth_cfg.Password
+		rst, err = c.passwordAuth(info)
+	}
+	if err != nil {
+		return err
 	}
 
 	if !rst.Ok {
-		return fmt.Errorf("auth fail: %s", rst.Message)
+		return authRefused(rst.Message)
 	}
-	log.Println(rst)
+	log.Println(rst.NatInfo, rst.Encoders)
 	c.nat_info = rst.NatInfo
+	c.token = rst.ResumeToken
+
+	encoders, err := c.packet.build(rst.Encoders)
+	if err != nil {
+		return fmt.Errorf("auth: %v", err)
+	}
+	if err := c.cli_ch.codec.setEncoders(encoders); err != nil {
+		return fmt.Errorf("auth: %v", err)
+	}
 
 	return nil
 }
 
 func (c *Client) nat() error {
-	tun, err := CreateTun("")
+	tun, err := CreateTunQueues("", c.tun_cfg.Queues)
 
 	if err != nil {
 		return err
 	}
 	defer tun.Close()
 
-	if err := tun.SetAddr(c.nat_info.IP, c.nat_info.Gateway); err != nil {
+	if err := c.address(tun, nil); err != nil {
+		return err
+	}
+
+	tun_ch, err := tun.ReadChan()
+	if err != nil {
 		return err
 	}
-	if err := tun.SetNetmask(c.nat_info.Netmask); err != nil {
+	if err := tun.Up(); err != nil {
 		return err
 	}
-	if c.nat_info.MTU > 0 {
-		if err := tun.SetMTU(c.nat_info.MTU); err != nil {
+
+	undo, err := c.pushRoutes(tun)
+	if err != nil {
+		return err
+	}
+	defer undo()
+
+	// the tun and its routes stay up while we reconnect, so traffic only
+	// stalls for a moment
+	for {
+		if err := c.forward(tun, tun_ch); err == errShutdown {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		c.hangup()
+
+		old := c.nat_info
+		if err := c.reconnect(); err == errShutdown {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := c.address(tun, &old); err != nil {
 			return err
 		}
 	}
+}
 
-	tun_ch, err := tun.ReadChan()
-	if err != nil {
+// address sets the tun up for c.nat_info, old is what the previous
+// connection had if the server could not resume it
+func (c *Client) address(tun *Tun, old *NatInfo) error {
+	nf := &c.nat_info
+	if old != nil {
+		if old.IP.Equal(nf.IP) && old.IP6.Equal(nf.IP6) && old.MTU == nf.MTU {
+			return nil
+		}
+		log.Println("tunnel address changed to", nf.IP)
+	}
+
+	if err := tun.SetAddr(nf.IP, nf.Gateway); err != nil {
 		return err
 	}
-	if err := tun.Up(); err != nil {
+	if err := tun.SetNetmask(nf.Netmask); err != nil {
 		return err
 	}
+	if old != nil && old.IP6 != nil && !old.IP6.Equal(nf.IP6) {
+		if err := tun.DelAddr(net.IPNet{IP: old.IP6, Mask: old.Netmask6}); err != nil {
+			return err
+		}
+	}
+	if nf.IP6 != nil && (old == nil || !old.IP6.Equal(nf.IP6)) {
+		ones, _ := nf.Netmask6.Size()
+		if err := tun.SetAddr6(nf.IP6, ones); err != nil {
+			return err
+		}
+	}
+	if nf.MTU > 0 {
+		if err := tun.SetMTU(nf.MTU); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// forward pumps packets until the connection ends, it only returns an
+// error if the tun failed or we shut down
+func (c *Client) forward(tun *Tun, tun_ch chan *Packet) error {
+	c.alive.seen()
 	for {
 		select {
 		case packet, ok := <-c.cli_ch.R:
@@ -125,25 +437,168 @@ func (c *Client) nat() error {
 				log.Println("tunnel closed")
 				return nil
 			}
+			c.alive.seen()
 			if packet.Type == PT_P2P {
-				if _, err := tun.Write(packet.Data); err != nil {
-					log.Println("data:", packet.Data, err)
+				if err := tun.Send(packet); err != nil {
+					log.Println("data:", err)
 					//return err
 				}
-			} else {
+			} else if packet.Type == PT_SHUTDOWN {
+				log.Println("connection lost:", errPeerShutdown)
+				return nil
+			} else if !c.alive.handle(&c.cli_ch, packet) {
 				log.Println("end")
 				return nil
 			}
-		case data, ok := <-tun_ch:
+		case packet, ok := <-tun_ch:
 			if !ok {
-				log.Println("chan closed")
+				return fmt.Errorf("tun closed")
+			}
+			if err := c.push(packet); err == errShutdown {
+				c.goodbye()
+				return err
+			} else if err != nil {
+				log.Println("connection lost:", err)
 				return nil
 			}
-			c.cli_ch.W <- NewPacket(PT_P2P, data)
 		case err := <-c.cli_ch.End:
+			log.Println("connection lost:", err)
+			return nil
+		case <-c.alive.C:
+			if err := c.alive.tick(&c.cli_ch); err != nil {
+				log.Println("connection lost:", err)
+				return nil
+			}
+		case <-c.quit:
+			c.goodbye()
+			return errShutdown
+		}
+	}
+}
+
+// push queues packet for the server. While the writer is stalled it keeps
+// pinging and watching for shutdown, so a dead server is still noticed.
+func (c *Client) push(packet *Packet) error {
+	for {
+		select {
+		case c.cli_ch.W <- packet:
+			return nil
+		case err := <-c.cli_ch.End:
+			packet.Release()
 			return err
+		case <-c.alive.C:
+			if err := c.alive.tick(&c.cli_ch); err != nil {
+				packet.Release()
+				return err
+			}
+		case <-c.quit:
+			packet.Release()
+			return errShutdown
 		}
 	}
+}
 
-	return nil
+// goodbye tells the server we are leaving, unless the tunnel is too backed
+// up to take it within flushTimeout
+func (c *Client) goodbye() {
+	select {
+	case c.cli_ch.W <- NewPacket(PT_SHUTDOWN, []byte{}):
+	case <-time.After(flushTimeout):
+		log.Println("tunnel stalled, leaving without goodbye")
+	}
+}
+
+type natRoute struct {
+	dst net.IPNet
+	gw  net.IP
+	dev string
+}
+
+func (c *Client) pushRoutes(tun *Tun) (undo func(), err error) {
+	var added []natRoute
+	var restoreDNS func() error
+
+	undo = func() {
+		for i := len(added) - 1; i >= 0; i-- {
+			r := added[i]
+			if err := DelRoute(r.dst, r.gw, r.dev); err != nil {
+				log.Println(err)
+			}
+		}
+		if restoreDNS != nil {
+			if err := restoreDNS(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	add := func(r natRoute) error {
+		if err := AddRoute(r.dst, r.gw, r.dev); err != nil {
+			return err
+		}
+		added = append(added, r)
+		return nil
+	}
+	defer func() {
+		if err != nil {
+			undo()
+		}
+	}()
+
+	if c.nat_info.RedirectGateway {
+		if err = c.pinServerRoute(add); err != nil {
+			return
+		}
+
+		halves := []string{"0.0.0.0/1", "128.0.0.0/1"}
+		if c.nat_info.IP6 != nil {
+			halves = append(halves, "::/1", "8000::/1")
+		}
+		for _, half := range halves {
+			_, dst, _ := net.ParseCIDR(half)
+			if err = add(natRoute{*dst, nil, tun.Name}); err != nil {
+				return
+			}
+		}
+	}
+
+	for _, dst := range c.nat_info.Routes {
+		if err = add(natRoute{dst, nil, tun.Name}); err != nil {
+			return
+		}
+	}
+
+	if len(c.nat_info.DNS) > 0 {
+		if restoreDNS, err = setDNS(c.nat_info.DNS); err != nil {
+			return
+		}
+	}
+
+	return undo, nil
+}
+
+func (c *Client) pinServerRoute(add func(natRoute) error) error {
+	ra, ok := c.tunnel.(remoteAddrer)
+	if !ok {
+		log.Println("tunnel has no remote address, not pinning server route")
+		return nil
+	}
+	host, _, err := net.SplitHostPort(ra.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+
+	var server net.IPNet
+	var gw net.IP
+	var dev string
+	if server.IP = net.ParseIP(host); server.IP.To4() != nil {
+		server.Mask = net.CIDRMask(32, 32)
+		gw, dev, err = defaultRoute()
+	} else {
+		server.Mask = net.CIDRMask(128, 128)
+		gw, dev, err = defaultRoute6()
+	}
+	if err != nil {
+		return err
+	}
+	return add(natRoute{server, gw, dev})
 }
@@ -3,11 +3,38 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
 	"secretun"
+	"syscall"
 )
 
 var cfgfile = flag.String("cfg", "cli.cfg", "configure file path")
 
+// logRTT writes the round trip time to the log on SIGUSR1
+func logRTT(cli *secretun.Client) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	for range sig {
+		log.Println("rtt", cli.RTT())
+	}
+}
+
+// shutdownOn calls shutdown on SIGINT or SIGTERM, a second one exits right
+// away
+func shutdownOn(shutdown func() error) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Println(<-sig, "- shutting down")
+	go func() {
+		log.Println(<-sig, "- exiting")
+		os.Exit(1)
+	}()
+	if err := shutdown(); err != nil {
+		log.Println("shutdown:", err)
+	}
+}
+
 func main() {
 	flag.Parse()
 	cfg, err := secretun.ConfigFromJson(*cfgfile)
@@ -23,6 +50,8 @@ func main() {
 			log.Println(err)
 			return
 		}
+		go logRTT(&cli)
+		go shutdownOn(cli.Shutdown)
 		if err = cli.Run(); err != nil {
 			log.Println(err)
 		}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"secretun"
+)
+
+var keyfile = flag.String("out", "server.key", "private key file path")
+var user = flag.String("user", "", "print an authorized_keys line for this client user")
+
+func main() {
+	flag.Parse()
+	private, public, err := secretun.GenerateKey()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if err := ioutil.WriteFile(*keyfile, []byte(private+"\n"), 0600); err != nil {
+		log.Println(err)
+		return
+	}
+	if len(*user) > 0 {
+		fmt.Println(public, *user)
+	} else {
+		fmt.Println("server_key:", public)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"secretun"
+	"strings"
+)
+
+var username = flag.String("user", "", "user name")
+var scram = flag.Bool("scram", false, "write a SCRAM-SHA-256 verifier, which challenge-response logins need, instead of a bcrypt hash")
+
+// reads the password from the first line of stdin and prints a users file
+// entry, e.g. echo secret | passwd -user alice >> users
+func main() {
+	flag.Parse()
+	if len(*username) == 0 {
+		flag.Usage()
+		return
+	}
+
+	fmt.Fprint(os.Stderr, "password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(password) == 0 {
+		log.Println(err)
+		return
+	}
+	password = strings.TrimRight(password, "\r\n")
+
+	hash := secretun.HashPassword
+	if *scram {
+		hash = secretun.HashScram
+	}
+	entry, err := hash(password)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Println(*username, entry)
+}
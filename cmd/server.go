@@ -3,11 +3,68 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
 	"secretun"
+	"syscall"
 )
 
 var cfgfile = flag.String("cfg", "ser.cfg", "configure file path")
 
+// logSessions writes the sessions to the log on SIGUSR1
+func logSessions(ser *secretun.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	for range sig {
+		sessions := ser.Sessions()
+		log.Printf("%d sessions", len(sessions))
+		for _, s := range sessions {
+			state := "resumable"
+			if s.Connected {
+				state = "rtt " + s.RTT.String()
+			}
+			log.Println(s.User, s.IP, s.IP6, state)
+		}
+	}
+}
+
+// reloadOn re-reads the configuration file on SIGHUP
+func reloadOn(ser *secretun.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		cfg, err := secretun.ConfigFromJson(*cfgfile)
+		if err != nil {
+			log.Println("reload:", err)
+			continue
+		}
+		restart, err := ser.Reload(cfg)
+		if err != nil {
+			log.Println("reload:", err)
+			continue
+		}
+		log.Println("reloaded", *cfgfile)
+		for _, name := range restart {
+			log.Println("reload:", name, "changed, restart to apply")
+		}
+	}
+}
+
+// shutdownOn calls shutdown on SIGINT or SIGTERM, a second one exits right
+// away
+func shutdownOn(shutdown func() error) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Println(<-sig, "- shutting down")
+	go func() {
+		log.Println(<-sig, "- exiting")
+		os.Exit(1)
+	}()
+	if err := shutdown(); err != nil {
+		log.Println("shutdown:", err)
+	}
+}
+
 func main() {
 	flag.Parse()
 	cfg, err := secretun.ConfigFromJson(*cfgfile)
@@ -23,6 +80,9 @@ func main() {
 			log.Println(err)
 			return
 		}
+		go logSessions(&ser)
+		go reloadOn(&ser)
+		go shutdownOn(ser.Shutdown)
 		if err = ser.Run(); err != nil {
 			log.Println(err)
 		}
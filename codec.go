@@ -0,0 +1,270 @@
+package secretun
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// The flags byte in the frame header tells how the payload was encoded.
+// The low bits name the key that sealed it, frameEncoded marks frames that
+// went through the encoders chosen during auth. Handshake packets never go
+// through the encoders, and PT_KEX is never sealed with the session key.
+const (
+	sealNone    = 0
+	sealPSK     = 1
+	sealSession = 2
+	sealMask    = 0x03
+
+	frameEncoded = 0x80
+)
+
+var sealNames = []string{"plain", "pre-shared key", "session key"}
+
+// codec turns packets into frames for one connection. The tunnel may read
+// frames before the consumer has set the codec up, so decode waits for
+// start, and for setEncoders on encoded frames.
+type codec struct {
+	lock     sync.RWMutex
+	psk      *AEADEncoder
+	session  *AEADEncoder
+	encoders Encoders
+	nworkers int
+	// features agreed on in the hello, none for clients without one
+	features []string
+	// handshake binds the keys of psk and the encoders, see bind
+	handshake []byte
+
+	started chan struct{}
+	ready   chan struct{}
+	done    <-chan struct{}
+}
+
+func newCodec(done <-chan struct{}) *codec {
+	return &codec{
+		started: make(chan struct{}),
+		ready:   make(chan struct{}),
+		done:    done,
+	}
+}
+
+func handshakePacket(t uint8) bool {
+	return t == PT_HELLO || t == PT_KEX || t == PT_AUTH || t == PT_CHALLENGE
+}
+
+// start lets frames through, sealed with psk if it is not nil, and
+// spreads them over that many workers each way
+func (c *codec) start(psk *AEADEncoder, workers int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.psk = psk
+	c.nworkers = max(workers, 1)
+	close(c.started)
+}
+
+// workers waits for start and tells how many workers the tunnel should
+// use, 1 if it closed before
+func (c *codec) workers() int {
+	if c.wait(c.started) != nil {
+		return 1
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.nworkers
+}
+
+// setKey seals every packet but PT_KEX with key from now on
+func (c *codec) setKey(key []byte) error {
+	session := &AEADEncoder{}
+	if err := session.SetKey(key); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.session = session
+	return nil
+}
+
+// setFeatures records the features both ends listed in the hello
+func (c *codec) setFeatures(features []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.features = features
+}
+
+// feature tells whether both ends support the protocol extension name
+func (c *codec) feature(name string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, f := range c.features {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// binder is implemented by encoders whose keys bind to the handshake
+type binder interface {
+	bind(handshake []byte) error
+}
+
+// bind makes the pre-shared key, and the encoders set later, derive their
+// keys from handshake too, so they differ for every connection. PT_HELLO
+// is still sealed with the plain keys, the peer binds once it has it.
+func (c *codec) bind(handshake []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.handshake = handshake
+	if c.psk != nil {
+		return c.psk.bind(handshake)
+	}
+	return nil
+}
+
+// setEncoders passes every packet but the handshake through es from now on
+func (c *codec) setEncoders(es Encoders) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.handshake != nil {
+		for _, e := range es {
+			if b, ok := e.(binder); ok {
+				if err := b.bind(c.handshake); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	c.encoders = es
+	close(c.ready)
+	return nil
+}
+
+func (c *codec) wait(ch chan struct{}) error {
+	select {
+	case <-ch:
+		return nil
+	case <-c.done:
+		return fmt.Errorf("tunnel closed")
+	}
+}
+
+func (c *codec) seal(t uint8) (*AEADEncoder, byte) {
+	switch {
+	case c.session != nil && t != PT_KEX:
+		return c.session, sealSession
+	case c.psk != nil:
+		return c.psk, sealPSK
+	}
+	return nil, sealNone
+}
+
+// encode turns p into a frame with reserve bytes in front for the
+// transport. It works in the buffer of p where it can, which leaves
+// p.Data garbled.
+func (c *codec) encode(p *Packet, reserve int) ([]byte, error) {
+	c.lock.RLock()
+	encoders := c.encoders
+	seal, header := c.seal(p.Type)
+	c.lock.RUnlock()
+
+	buf, off := p.serialize()
+	if encoders != nil && !handshakePacket(p.Type) {
+		if len(encoders) > 0 {
+			data, err := encoders.Encode(buf[off:])
+			if err != nil {
+				return nil, err
+			}
+			buf, off = data, 0
+		}
+		header |= frameEncoded
+	}
+	if seal != nil {
+		var err error
+		if buf, off, err = seal.sealAt(buf, off, p.Type != PT_HELLO); err != nil {
+			return nil, err
+		}
+	}
+	return frameAt(header, buf, off, reserve)
+}
+
+// decode turns a frame into a packet, in place. The packet owns the frame
+// from then on and gives it back to the pool on Release.
+func (c *codec) decode(frame []byte) (*Packet, error) {
+	header, data, err := parseFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.wait(c.started); err != nil {
+		return nil, err
+	}
+
+	c.lock.RLock()
+	seal, want := c.seal(PT_UNKNOWN)
+	c.lock.RUnlock()
+
+	if got := header & sealMask; got != want {
+		if int(got) >= len(sealNames) {
+			return nil, fmt.Errorf("invalid frame header %#x", header)
+		}
+		return nil, fmt.Errorf("packet sealed with %s, expected %s",
+			sealNames[got], sealNames[want])
+	}
+	if seal != nil {
+		if data, err = seal.Decode(data); err != nil {
+			return nil, err
+		}
+	}
+
+	encoded := header&frameEncoded != 0
+	if encoded {
+		if err := c.wait(c.ready); err != nil {
+			return nil, err
+		}
+		if data, err = c.encoders.Decode(data); err != nil {
+			return nil, err
+		}
+	}
+
+	p, err := DeserializePacket(data)
+	if err != nil {
+		return nil, err
+	}
+	p.buf = frame
+	if !encoded && !handshakePacket(p.Type) && c.hasEncoders() {
+		return nil, fmt.Errorf("packet type %d skipped the encoders", p.Type)
+	}
+	return p, nil
+}
+
+// sealedFrame tells if a frame that decoded was opened with a key, which
+// makes it authentic. decode leaves the header alone.
+func sealedFrame(frame []byte) bool {
+	return len(frame) >= frameHeaderSize && frame[frameHeaderSize-1]&sealMask != sealNone
+}
+
+// openingFrame tells if frame could start a connection: a handshake packet
+// in the clear, or one sealed with an unbound pre-shared key. Tunnels
+// without connections check this before they keep state for a peer.
+func openingFrame(frame []byte) bool {
+	header, data, err := parseFrame(frame)
+	if err != nil || header&frameEncoded != 0 {
+		return false
+	}
+	switch header & sealMask {
+	case sealNone:
+		p, err := DeserializePacket(data)
+		return err == nil && (p.Type == PT_HELLO || p.Type == PT_KEX || p.Type == PT_AUTH)
+	case sealPSK:
+		return len(data) >= aeadHeaderSize+aeadTagSize &&
+			binary.BigEndian.Uint64(data[aeadSaltSize:])&aeadBoundSeq == 0
+	}
+	return false
+}
+
+func (c *codec) hasEncoders() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.encoders != nil
+}
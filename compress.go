@@ -2,12 +2,42 @@ package secretun
 
 import (
 	"bytes"
+	"compress/flate"
 	zlib "compress/zlib"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"sync"
 )
 
+// deflate and snappy put one of these in front of every packet, packets
+// that don't get smaller are sent as they are
+const (
+	packetStored     = 0
+	packetCompressed = 1
+)
+
+// syncMarker ends every flushed deflate block, it is left off on the wire
+var syncMarker = []byte{0, 0, 0xff, 0xff}
+
 type ZlibEncoder struct {
-	level int
+	level   int
+	writers *sync.Pool
+}
+
+// a zlib writer holds about a megabyte of state, so they are reset and
+// reused rather than made for every packet
+var (
+	zlibWriters sync.Map // level -> *sync.Pool
+	zlibReaders sync.Pool
+)
+
+func zlibWriterPool(level int) *sync.Pool {
+	if pool, ok := zlibWriters.Load(level); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := zlibWriters.LoadOrStore(level, &sync.Pool{})
+	return pool.(*sync.Pool)
 }
 
 func (z *ZlibEncoder) Init(cfg Config) error {
@@ -19,40 +49,205 @@ func (z *ZlibEncoder) Init(cfg Config) error {
 		}
 	}
 
+	if z.level < zlib.HuffmanOnly || z.level > zlib.BestCompression {
+		return fmt.Errorf("zlib: invalid level %d", z.level)
+	}
+	z.writers = zlibWriterPool(z.level)
 	return nil
 }
 
 func (z *ZlibEncoder) Encode(data []byte) ([]byte, error) {
-	w := new(bytes.Buffer)
-	dec, err := zlib.NewWriterLevel(w, z.level)
-	if err != nil {
-		return nil, err
+	w := bytes.NewBuffer(make([]byte, 0, len(data)+64))
+	enc, ok := z.writers.Get().(*zlib.Writer)
+	if ok {
+		enc.Reset(w)
+	} else {
+		var err error
+		if enc, err = zlib.NewWriterLevel(w, z.level); err != nil {
+			return nil, err
+		}
 	}
-	defer dec.Close()
+	defer z.writers.Put(enc)
 
-	if _, err = dec.Write(data); err != nil {
+	// flushed but not closed, the peer reads up to the sync marker
+	if _, err := enc.Write(data); err != nil {
 		return nil, err
 	}
-	if err = dec.Flush(); err != nil {
+	if err := enc.Flush(); err != nil {
 		return nil, err
 	}
 	return w.Bytes(), nil
 }
 
 func (z *ZlibEncoder) Decode(data []byte) ([]byte, error) {
-	w := new(bytes.Buffer)
-	if r, err := zlib.NewReader(bytes.NewBuffer(data)); err != nil {
-		return nil, err
+	src := bytes.NewReader(data)
+	r, ok := zlibReaders.Get().(io.ReadCloser)
+	if ok {
+		if err := r.(zlib.Resetter).Reset(src, nil); err != nil {
+			return nil, err
+		}
 	} else {
-		if _, err = io.Copy(w, r); err != nil {
-			if err != io.ErrUnexpectedEOF && err != io.EOF {
-				return nil, err
-			}
+		var err error
+		if r, err = zlib.NewReader(src); err != nil {
+			return nil, err
+		}
+	}
+	defer zlibReaders.Put(r)
+
+	w := bytes.NewBuffer(make([]byte, 0, 4*len(data)))
+	if _, err := io.Copy(w, r); err != nil {
+		if err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
 		}
 	}
 	return w.Bytes(), nil
 }
 
+// DeflateEncoder compresses the packets of a connection as one deflate
+// stream, so later packets refer back to earlier ones and even small ones
+// shrink. Every packet is flushed on its own. A packet that doesn't get
+// smaller is stored, and the receiver adds it to its window as a stored
+// block, which is all the sender's window holds from it too. Below level 7
+// compress/flate doesn't look for repeats in flushes of less than 128
+// bytes, so level defaults to 9.
+type DeflateEncoder struct {
+	level int
+
+	w    *flate.Writer
+	wbuf bytes.Buffer
+	r    io.Reader
+	in   streamInput
+}
+
+func (d *DeflateEncoder) Init(cfg Config) error {
+	d.level = flate.BestCompression
+	if err := cfg.GetOptional("level", &d.level); err != nil {
+		return err
+	}
+	if d.level < flate.HuffmanOnly || d.level > flate.BestCompression {
+		return fmt.Errorf("deflate: invalid level %d", d.level)
+	}
+	return nil
+}
+
+// Stream marks d as stateful, it needs every packet in order
+func (d *DeflateEncoder) Stream() {}
+
+func (d *DeflateEncoder) Encode(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return []byte{packetStored}, nil
+	}
+	// the writer takes about a megabyte, so made on first use rather than
+	// in Init, which also runs to check the configuration
+	if d.w == nil {
+		var err error
+		if d.w, err = flate.NewWriter(&d.wbuf, d.level); err != nil {
+			return nil, err
+		}
+	}
+
+	d.wbuf.Reset()
+	if _, err := d.w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := d.w.Flush(); err != nil {
+		return nil, err
+	}
+	deflated := d.wbuf.Bytes()
+	if !bytes.HasSuffix(deflated, syncMarker) {
+		return nil, fmt.Errorf("deflate: flush without sync marker")
+	}
+	deflated = deflated[:len(deflated)-len(syncMarker)]
+
+	out := make([]byte, 0, 1+binary.MaxVarintLen32+len(deflated))
+	out = append(out, packetCompressed)
+	out = binary.AppendUvarint(out, uint64(len(data)))
+	if len(out)+len(deflated) >= 1+len(data) {
+		return append(append(out[:0], packetStored), data...), nil
+	}
+	return append(out, deflated...), nil
+}
+
+func (d *DeflateEncoder) Decode(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("deflate: empty packet")
+	}
+	if d.r == nil {
+		d.r = flate.NewReader(&d.in)
+	}
+
+	var out []byte
+	switch data[0] {
+	case packetStored:
+		out = data[1:]
+		d.in.feed(storedBlocks(out))
+	case packetCompressed:
+		size, n := binary.Uvarint(data[1:])
+		if n <= 0 || size == 0 || size > maxFrameSize {
+			return nil, fmt.Errorf("deflate: invalid packet size")
+		}
+		out = make([]byte, size)
+		d.in.feed(data[1+n:], syncMarker)
+	default:
+		return nil, fmt.Errorf("deflate: invalid packet flag %d", data[0])
+	}
+
+	// read no further than the packet, the stream goes on with the next
+	if _, err := io.ReadFull(d.r, out); err != nil {
+		return nil, fmt.Errorf("deflate: %v", err)
+	}
+	return out, nil
+}
+
+// storedBlocks wraps data in stored deflate blocks. The reader is at a
+// block boundary and byte aligned after a sync marker or a stored block.
+// They end with an empty one, only that makes the reader hand out the data.
+func storedBlocks(data []byte) []byte {
+	blocks := make([]byte, 0, len(data)+5*(len(data)/0xffff+2))
+	for len(data) > 0 {
+		n := min(len(data), 0xffff)
+		blocks = append(blocks, 0, byte(n), byte(n>>8), ^byte(n), ^byte(n>>8))
+		blocks = append(blocks, data[:n]...)
+		data = data[n:]
+	}
+	return append(append(blocks, 0), syncMarker...)
+}
+
+// streamInput is what the deflate reader reads from. It ends with the
+// packet fed last, whatever of it the reader didn't need yet stays for the
+// next one.
+type streamInput struct {
+	buf  []byte
+	data []byte
+}
+
+func (s *streamInput) feed(parts ...[]byte) {
+	buf := append(s.buf[:0], s.data...)
+	for _, p := range parts {
+		buf = append(buf, p...)
+	}
+	s.buf, s.data = buf, buf
+}
+
+func (s *streamInput) Read(p []byte) (int, error) {
+	if len(s.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+func (s *streamInput) ReadByte() (byte, error) {
+	if len(s.data) == 0 {
+		return 0, io.EOF
+	}
+	b := s.data[0]
+	s.data = s.data[1:]
+	return b, nil
+}
+
 func init() {
 	RegisterEncoder("zlib", ZlibEncoder{})
+	RegisterEncoder("deflate", DeflateEncoder{})
 }
@@ -146,6 +146,14 @@ func (c *Config) Get(name string, dest interface{}) error {
 	return nil
 }
 
+// GetOptional is Get that leaves dest untouched when name is missing
+func (c *Config) GetOptional(name string, dest interface{}) error {
+	if err := c.Get(name, dest); err != nil && err.(*ConfigError).Errno != ErrMissing {
+		return err
+	}
+	return nil
+}
+
 func (c *Config) GetBool(name string) bool {
 	var b bool
 	if err := c.Get(name, &b); err != nil {
@@ -266,7 +274,7 @@ func convertString(in interface{}, val reflect.Value) *ConfigError {
 
 func convertStruct(in interface{}, val reflect.Value) *ConfigError {
 	dict, ok := in.(map[string]interface{})
-	if !ok || len(dict) != val.NumField() {
+	if !ok || len(dict) > val.NumField() {
 		return &ConfigError{ErrInvalidType, ""}
 	}
 
@@ -291,6 +299,21 @@ func convertStruct(in interface{}, val reflect.Value) *ConfigError {
 		}
 	}
 
+	// every field is required unless tagged config:"optional"
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Tag.Get("config") == "optional" {
+			continue
+		}
+		k := strings.ToLower(field.Name[:1]) + field.Name[1:]
+		if _, ok := dict[k]; ok {
+			continue
+		} else if _, ok := dict[field.Name]; !ok {
+			return &ConfigError{ErrMissing, k}
+		}
+	}
+
 	return nil
 }
 
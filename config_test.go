@@ -0,0 +1,40 @@
+package secretun
+
+import "testing"
+
+func TestConfigStruct(t *testing.T) {
+	type section struct {
+		Name  string
+		Size  int
+		Extra bool `config:"optional"`
+	}
+	for _, c := range []struct {
+		in    map[string]interface{}
+		errno int
+	}{
+		{map[string]interface{}{"name": "a", "size": 1.0}, ErrNone},
+		{map[string]interface{}{"name": "a", "size": 1.0, "extra": true}, ErrNone},
+		{map[string]interface{}{"Name": "a", "Size": 1.0}, ErrNone},
+		{map[string]interface{}{"name": "a"}, ErrMissing},
+		{map[string]interface{}{"name": "a", "extra": true}, ErrMissing},
+		{map[string]interface{}{"name": "a", "size": 1.0, "other": 1.0}, ErrInvalidType},
+		{map[string]interface{}{"name": 1.0, "size": 1.0}, ErrInvalidType},
+	} {
+		var s section
+		cfg := Config{Map: map[string]interface{}{"section": c.in}, Name: "test"}
+		err := cfg.Get("section", &s)
+		if c.errno == ErrNone {
+			if err != nil {
+				t.Errorf("%v: %v", c.in, err)
+			}
+		} else if err == nil || err.(*ConfigError).Errno != c.errno {
+			t.Errorf("%v: got %v, want errno %d", c.in, err, c.errno)
+		}
+	}
+
+	var s section
+	cfg := Config{Map: map[string]interface{}{"section": map[string]interface{}{"name": "a"}}, Name: "test"}
+	if err := cfg.Get("section", &s); err == nil || err.Error() != "config: missing test.section.size" {
+		t.Errorf("got %v", err)
+	}
+}
@@ -13,6 +13,19 @@ type Encoder interface {
 
 type Encoders []Encoder
 
+// EncoderParams is implemented by encoders that only work when both ends
+// agree on more than the name. Params must not reveal secrets.
+type EncoderParams interface {
+	Params() map[string]string
+}
+
+// StreamEncoder is implemented by encoders that carry state from one packet
+// to the next. They need every packet in order, so they can't be used over
+// udp or with more than one worker.
+type StreamEncoder interface {
+	Stream()
+}
+
 var registered_encoders = map[string]reflect.Type{}
 
 func RegisterEncoder(name string, i interface{}) {
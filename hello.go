@@ -0,0 +1,148 @@
+package secretun
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+)
+
+// Connections open with a PT_HELLO in which the client names the protocol
+// versions it speaks and the features it supports. The server answers with
+// its own and the version it picked, or with Version 0 and a Message if
+// they have no version in common. Features are used if both sides list
+// them. From version 3 on both send a nonce, and the pre-shared key and
+// aead encoders bind to them, see codec.bind.
+//
+// Version 1 clients predate the hello and start with PT_KEX or PT_AUTH,
+// the server still takes them, as it takes version 2 clients, unless it
+// seals with a key they can't bind.
+
+const (
+	protocolV1         = 1
+	protocolBound      = 3
+	minProtocolVersion = 1
+	protocolVersion    = 3
+
+	helloNonceSize = 32
+
+	// featureResume is session resumption, the server only hands out
+	// resume tokens to clients that list it
+	featureResume = "resume"
+)
+
+// protocolFeatures are the optional extensions this build supports
+var protocolFeatures = []string{featureResume}
+
+func commonFeatures(ours, theirs []string) []string {
+	var common []string
+	for _, f := range ours {
+		for _, t := range theirs {
+			if f == t {
+				common = append(common, f)
+				break
+			}
+		}
+	}
+	return common
+}
+
+func helloNonce() ([]byte, error) {
+	nonce := make([]byte, helloNonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// clientHello is the client half, it fails if the server has no version
+// in common with us
+func clientHello(cli_ch *ClientChan) error {
+	nonce, err := helloNonce()
+	if err != nil {
+		return err
+	}
+	cli_ch.W <- NewPacket(PT_HELLO, &Hello{
+		MinVersion: protocolVersion,
+		MaxVersion: protocolVersion,
+		Features:   protocolFeatures,
+		Nonce:      nonce,
+	})
+
+	p, err := cli_ch.Recv()
+	if err != nil {
+		return err
+	}
+	var hello Hello
+	if p.Type == PT_AUTH {
+		var rst AuthResult
+		if p.Decode(&rst) == nil && len(rst.Message) > 0 {
+			return authRefused(rst.Message)
+		}
+		return fmt.Errorf("hello: refused by server")
+	} else if p.Type != PT_HELLO || p.Decode(&hello) != nil {
+		return fmt.Errorf("hello: invalid reply")
+	}
+	if hello.Version == 0 {
+		return authRefused(hello.Message)
+	} else if hello.Version != protocolVersion {
+		return fmt.Errorf("hello: server picked unsupported version %d", hello.Version)
+	} else if len(hello.Nonce) != helloNonceSize {
+		return fmt.Errorf("hello: invalid nonce")
+	}
+	cli_ch.codec.setFeatures(commonFeatures(protocolFeatures, hello.Features))
+	return cli_ch.codec.bind(append(nonce, hello.Nonce...))
+}
+
+// serverHello answers the PT_HELLO in p. keyed tells whether the client has
+// to bind keys, which takes protocolBound.
+func serverHello(cli_ch *ClientChan, p *Packet, keyed bool) error {
+	var hello Hello
+	if p.Decode(&hello) != nil {
+		return fmt.Errorf("hello: invalid hello")
+	}
+
+	reply := Hello{
+		MinVersion: minProtocolVersion,
+		MaxVersion: protocolVersion,
+		Features:   protocolFeatures,
+		Version:    min(hello.MaxVersion, protocolVersion),
+	}
+	if reply.Version < max(hello.MinVersion, minProtocolVersion) {
+		reply.Message = fmt.Sprintf("client speaks protocol versions %d to %d, server %d to %d",
+			hello.MinVersion, hello.MaxVersion, minProtocolVersion, protocolVersion)
+	} else if keyed && reply.Version < protocolBound {
+		reply.Message = fmt.Sprintf("protocol version %d clients can't use the packet keys, upgrade the client",
+			reply.Version)
+	} else if reply.Version >= protocolBound && len(hello.Nonce) != helloNonceSize {
+		reply.Message = "invalid nonce"
+	}
+	if len(reply.Message) > 0 {
+		reply.Version = 0
+		cli_ch.W <- NewPacket(PT_HELLO, &reply)
+		return fmt.Errorf("hello: %s", reply.Message)
+	}
+
+	if reply.Version >= protocolBound {
+		var err error
+		if reply.Nonce, err = helloNonce(); err != nil {
+			return err
+		}
+		// PT_HELLO is never sealed with the bound keys, the reply may go
+		// out after this
+		handshake := append(append([]byte{}, hello.Nonce...), reply.Nonce...)
+		if err = cli_ch.codec.bind(handshake); err != nil {
+			return err
+		}
+	}
+	cli_ch.codec.setFeatures(commonFeatures(protocolFeatures, hello.Features))
+	cli_ch.W <- NewPacket(PT_HELLO, &reply)
+	return nil
+}
+
+// legacyHello is what the server assumes for clients that skip the hello,
+// keyed as for serverHello
+func legacyHello(keyed bool) error {
+	if keyed {
+		return fmt.Errorf("protocol version %d clients can't use the packet keys, upgrade the client", protocolV1)
+	}
+	log.Printf("protocol version %d client, it should be upgraded", protocolV1)
+	return nil
+}
@@ -0,0 +1,114 @@
+package secretun
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultPingInterval = 10
+	defaultPingTimeout  = 30
+)
+
+// keepaliveConfig is how often to ping the peer and how long it may stay
+// silent before the connection counts as dead. Interval 0 turns pings off.
+type keepaliveConfig struct {
+	Interval int `config:"optional"`
+	Timeout  int `config:"optional"`
+}
+
+func newKeepaliveConfig(cfg Config) (kc keepaliveConfig, err error) {
+	kc = keepaliveConfig{defaultPingInterval, defaultPingTimeout}
+	if err = cfg.GetOptional("keepalive", &kc); err != nil {
+		return
+	}
+	if kc.Interval < 0 || (kc.Interval > 0 && kc.Timeout <= kc.Interval) {
+		err = fmt.Errorf("keepalive: timeout must be longer than interval")
+	}
+	return
+}
+
+// clockBase makes ping payloads monotonic, they only come back to us
+var clockBase = time.Now()
+
+// keepalive tracks one connection. Any packet from the peer counts as a
+// sign of life, pongs also measure the round trip time.
+type keepalive struct {
+	interval time.Duration
+	timeout  time.Duration
+	last     time.Time
+	rtt      atomic.Int64
+	C        <-chan time.Time
+
+	ticker *time.Ticker
+}
+
+func newKeepalive(kc keepaliveConfig) *keepalive {
+	k := &keepalive{
+		interval: time.Duration(kc.Interval) * time.Second,
+		timeout:  time.Duration(kc.Timeout) * time.Second,
+		last:     time.Now(),
+	}
+	if k.interval > 0 {
+		k.ticker = time.NewTicker(k.interval)
+		k.C = k.ticker.C
+	}
+	return k
+}
+
+func (k *keepalive) Stop() {
+	if k.ticker != nil {
+		k.ticker.Stop()
+	}
+}
+
+// RTT is the last measured round trip time, 0 before the first pong
+func (k *keepalive) RTT() time.Duration {
+	return time.Duration(k.rtt.Load())
+}
+
+// tick sends a ping, or fails once the peer was silent for too long
+func (k *keepalive) tick(cli_ch *ClientChan) error {
+	if silent := time.Since(k.last); silent > k.timeout {
+		return fmt.Errorf("peer silent for %v", silent.Round(time.Second))
+	}
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(time.Since(clockBase)))
+	queue(cli_ch, NewPacket(PT_PING, data))
+	return nil
+}
+
+// queue sends p if the tunnel has room. A lost ping or pong only costs an
+// rtt sample, blocking would stall the loop that has to notice a dead peer.
+func queue(cli_ch *ClientChan, p *Packet) {
+	select {
+	case cli_ch.W <- p:
+	default:
+	}
+}
+
+// seen is called for every packet from the peer
+func (k *keepalive) seen() {
+	k.last = time.Now()
+}
+
+// handle answers pings and measures pongs, it returns false for any other
+// packet type
+func (k *keepalive) handle(cli_ch *ClientChan, p *Packet) bool {
+	switch p.Type {
+	case PT_PING:
+		queue(cli_ch, NewPacket(PT_PONG, p.Data))
+	case PT_PONG:
+		if len(p.Data) == 8 {
+			sent := time.Duration(binary.BigEndian.Uint64(p.Data))
+			if rtt := time.Since(clockBase) - sent; rtt >= 0 {
+				k.rtt.Store(int64(rtt))
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package secretun
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Before PT_AUTH the client may send a PT_KEX with an ephemeral X25519 key.
+// The server answers with its own ephemeral key, signed by its long-term
+// ed25519 key, and both ends switch the connection to a session key derived
+// from the shared secret. The ephemeral keys are thrown away afterwards, so
+// neither a later session nor the long-term key reveals earlier traffic.
+
+const (
+	kexTranscriptLabel = "secretun kex v1"
+	kexSessionInfo     = "secretun session"
+	kexSessionKeySize  = 32
+)
+
+func kexTranscript(client_pub, server_pub []byte) []byte {
+	t := make([]byte, 0, len(kexTranscriptLabel)+len(client_pub)+len(server_pub))
+	t = append(t, kexTranscriptLabel...)
+	t = append(t, client_pub...)
+	return append(t, server_pub...)
+}
+
+func kexSessionKey(priv *ecdh.PrivateKey, peer, client_pub, server_pub []byte) ([]byte, error) {
+	peer_key, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, fmt.Errorf("kex: %v", err)
+	}
+	shared, err := priv.ECDH(peer_key)
+	if err != nil {
+		return nil, fmt.Errorf("kex: %v", err)
+	}
+	return hkdf.Key(sha256.New, shared, kexTranscript(client_pub, server_pub),
+		kexSessionInfo, kexSessionKeySize)
+}
+
+// clientKex runs the client half of the exchange, server_key is the
+// server's long-term public key
+func clientKex(cli_ch *ClientChan, server_key ed25519.PublicKey) error {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	client_pub := priv.PublicKey().Bytes()
+	cli_ch.W <- NewPacket(PT_KEX, &KexInit{client_pub})
+
+	p, err := cli_ch.Recv()
+	if err != nil {
+		return err
+	}
+	if p.Type == PT_AUTH {
+		var rst AuthResult
+		if p.Decode(&rst) == nil && len(rst.Message) > 0 {
+			return fmt.Errorf("kex: %s", rst.Message)
+		}
+		return fmt.Errorf("kex: refused by server")
+	}
+
+	var reply KexReply
+	if p.Type != PT_KEX || p.Decode(&reply) != nil {
+		return fmt.Errorf("kex: invalid reply")
+	}
+	if !ed25519.Verify(server_key, kexTranscript(client_pub, reply.Public), reply.Signature) {
+		return fmt.Errorf("kex: bad server signature, wrong server_key?")
+	}
+
+	key, err := kexSessionKey(priv, reply.Public, client_pub, reply.Public)
+	if err != nil {
+		return err
+	}
+	return cli_ch.codec.setKey(key)
+}
+
+// serverKex answers the PT_KEX in p, signing with key
+func serverKex(cli_ch *ClientChan, p *Packet, key ed25519.PrivateKey) error {
+	var init KexInit
+	if p.Decode(&init) != nil {
+		return fmt.Errorf("kex: invalid init")
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	server_pub := priv.PublicKey().Bytes()
+	session, err := kexSessionKey(priv, init.Public, init.Public, server_pub)
+	if err != nil {
+		return err
+	}
+
+	// install the key first, PT_KEX itself is never sealed with it, and
+	// the client may answer as soon as it sees the reply
+	if err := cli_ch.codec.setKey(session); err != nil {
+		return err
+	}
+	sig := ed25519.Sign(key, kexTranscript(init.Public, server_pub))
+	cli_ch.W <- NewPacket(PT_KEX, &KexReply{server_pub, sig})
+	return nil
+}
+
+// GenerateKey returns a new ed25519 key pair, base64 encoded the way
+// key_file, server_key and authorized_keys expect them
+func GenerateKey() (private, public string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	private = base64.StdEncoding.EncodeToString(priv.Seed())
+	public = base64.StdEncoding.EncodeToString(pub)
+	return
+}
+
+// loadPrivateKey reads a base64 ed25519 seed, as written by keygen
+func loadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: invalid ed25519 key", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	pub, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key: %s", s)
+	}
+	return ed25519.PublicKey(pub), nil
+}
+
+func parseServerKey(s string) (ed25519.PublicKey, error) {
+	pub, err := parsePublicKey(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server_key: %s", s)
+	}
+	return pub, nil
+}
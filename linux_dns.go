@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package secretun
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	resolvConf = "/etc/resolv.conf"
+	// resolvBackup holds the original while ours is in place, a client
+	// that died without restoring it does so at its next start
+	resolvBackup = resolvConf + ".secretun"
+	resolvMarker = "# generated by secretun\n"
+)
+
+// setDNS puts servers in front of resolv.conf, replacing its nameservers
+// but keeping search, options and the rest
+func setDNS(servers []net.IP) (restore func() error, err error) {
+	if err = recoverDNS(); err != nil {
+		return nil, err
+	}
+	old, err := ioutil.ReadFile(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(resolvBackup, old, 0644); err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(resolvMarker)
+	for _, ip := range servers {
+		buf.WriteString("nameserver " + ip.String() + "\n")
+	}
+	for _, line := range strings.SplitAfter(string(old), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "nameserver" {
+			continue
+		}
+		buf.WriteString(line)
+	}
+	if err = ioutil.WriteFile(resolvConf, buf.Bytes(), 0644); err != nil {
+		os.Remove(resolvBackup)
+		return nil, err
+	}
+
+	return func() error {
+		if err := ioutil.WriteFile(resolvConf, old, 0644); err != nil {
+			return err
+		}
+		return os.Remove(resolvBackup)
+	}, nil
+}
+
+// recoverDNS puts back the resolv.conf a previous client left a backup of,
+// unless something else rewrote it since
+func recoverDNS() error {
+	old, err := ioutil.ReadFile(resolvBackup)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	current, err := ioutil.ReadFile(resolvConf)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if bytes.HasPrefix(current, []byte(resolvMarker)) {
+		log.Println("restoring", resolvConf, "left by a previous run")
+		if err := ioutil.WriteFile(resolvConf, old, 0644); err != nil {
+			return err
+		}
+	}
+	return os.Remove(resolvBackup)
+}
@@ -0,0 +1,110 @@
+//go:build linux
+// +build linux
+
+package secretun
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+var netlinkSeq uint32
+
+type netlinkRequest struct {
+	typ   uint16
+	flags uint16
+	body  []byte
+}
+
+func nlAlign(n int) int {
+	return (n + syscall.NLMSG_ALIGNTO - 1) & ^(syscall.NLMSG_ALIGNTO - 1)
+}
+
+func newNetlinkRequest(typ, flags int, msg unsafe.Pointer, size int) *netlinkRequest {
+	req := &netlinkRequest{typ: uint16(typ), flags: uint16(flags | syscall.NLM_F_REQUEST)}
+	req.body = append(req.body, unsafe.Slice((*byte)(msg), size)...)
+	return req
+}
+
+func (r *netlinkRequest) addAttr(typ uint16, data []byte) {
+	var hdr [syscall.SizeofRtAttr]byte
+	binary.NativeEndian.PutUint16(hdr[0:2], uint16(syscall.SizeofRtAttr+len(data)))
+	binary.NativeEndian.PutUint16(hdr[2:4], typ)
+
+	r.body = append(r.body, hdr[:]...)
+	r.body = append(r.body, data...)
+	for len(r.body) != nlAlign(len(r.body)) {
+		r.body = append(r.body, 0)
+	}
+}
+
+func (r *netlinkRequest) addUint32(typ uint16, v uint32) {
+	var b [4]byte
+	binary.NativeEndian.PutUint32(b[:], v)
+	r.addAttr(typ, b[:])
+}
+
+func (r *netlinkRequest) serialize(seq uint32) []byte {
+	b := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(r.body))
+	binary.NativeEndian.PutUint32(b[0:4], uint32(syscall.NLMSG_HDRLEN+len(r.body)))
+	binary.NativeEndian.PutUint16(b[4:6], r.typ)
+	binary.NativeEndian.PutUint16(b[6:8], r.flags)
+	binary.NativeEndian.PutUint32(b[8:12], seq)
+	return append(b, r.body...)
+}
+
+// Execute sends the request and collects the replies up to the final ack
+// or NLMSG_DONE. Kernel errors come back as syscall.Errno.
+func (r *netlinkRequest) Execute() ([]syscall.NetlinkMessage, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	seq := atomic.AddUint32(&netlinkSeq, 1)
+	if err := syscall.Sendto(fd, r.serialize(seq), 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+
+	var replies []syscall.NetlinkMessage
+	buf := make([]byte, os.Getpagesize()*4)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return replies, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, fmt.Errorf("netlink: short error message")
+				}
+				if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return nil, os.NewSyscallError("netlink", syscall.Errno(-errno))
+				}
+				return replies, nil
+			default:
+				replies = append(replies, m)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package secretun
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	procRoute  = "/proc/net/route"
+	procRoute6 = "/proc/net/ipv6_route"
+)
+
+func procAddr(hex string) (net.IP, error) {
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, err
+	}
+	ip := make(net.IP, 4)
+	binary.NativeEndian.PutUint32(ip, uint32(v))
+	return ip, nil
+}
+
+func defaultRoute() (gw net.IP, dev string, err error) {
+	f, err := os.Open(procRoute)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		if gw, err = procAddr(fields[2]); err != nil {
+			return
+		}
+		if gw.IsUnspecified() {
+			gw = nil
+		}
+		return gw, fields[0], nil
+	}
+	if err = scanner.Err(); err == nil {
+		err = fmt.Errorf("no default route")
+	}
+	return
+}
+
+func defaultRoute6() (gw net.IP, dev string, err error) {
+	f, err := os.Open(procRoute6)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	zero := strings.Repeat("0", 32)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[0] != zero || fields[1] != "00" || fields[9] == "lo" {
+			continue
+		}
+		var b []byte
+		if b, err = hex.DecodeString(fields[4]); err != nil {
+			return
+		}
+		if gw = net.IP(b); gw.IsUnspecified() {
+			gw = nil
+		}
+		return gw, fields[9], nil
+	}
+	if err = scanner.Err(); err == nil {
+		err = fmt.Errorf("no default ipv6 route")
+	}
+	return
+}
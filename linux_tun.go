@@ -1,218 +1,219 @@
-package secretun
-
+//go:build linux
 // +build linux
 
-/*
-#include <string.h>
-#include <stdlib.h>
-#include <unistd.h>
-#include <sys/ioctl.h>
-#include <sys/socket.h>
-#include <arpa/inet.h>
-#include <netinet/in.h>
-#include <linux/if.h>
-#include <linux/if_tun.h>
-
-int create_tun(int fd, char *name) {
-    int err;
-    struct ifreq ifr;
-    memset(&ifr, 0, sizeof(ifr));
-
-    if (name && name[0]) {
-        strncpy(ifr.ifr_name, name, IFNAMSIZ - 1);
-    }
-    ifr.ifr_flags = IFF_NO_PI | IFF_TUN;
-    if ((err = ioctl(fd, TUNSETIFF, (void*)&ifr)) < 0) {
-        return err;
-    }
-    if (name) {
-        strcpy(name, ifr.ifr_name);
-    }
-
-    return 0;
-}
-
-int if_ioctl(int cmd, struct ifreq *ifr) {
-    int ret;
-    int sock = socket(AF_INET, SOCK_DGRAM, 0);
-    if (sock < 0) {
-        return -1;
-    }
-    ret = ioctl(sock, cmd, (void*)ifr);
-    close(sock);
-
-    return ret;
-}
-
-int if_setaddr(int cmd, const char *name, const char *ip) {
-    int err;
-    struct ifreq ifr;
-    struct sockaddr_in *addr;
-    memset(&ifr, 0, sizeof(ifr));
-
-    strcpy(ifr.ifr_name, name);
-    addr = (struct sockaddr_in*)&ifr.ifr_ifru.ifru_dstaddr;
-    addr->sin_family = AF_INET;
-    if ((err = inet_aton(ip, &addr->sin_addr)) < 0) {
-        return err;
-    }
-    return if_ioctl(cmd, &ifr);
-}
-
-int if_getaddr(int cmd, const char *name, char **addr) {
-    int err;
-    struct ifreq ifr;
-    memset(&ifr, 0, sizeof(ifr));
-
-    strcpy(ifr.ifr_name, name);
-    if ((err = if_ioctl(cmd, &ifr)) < 0) {
-        return err;
-    }
-
-    *addr = inet_ntoa(((struct sockaddr_in*)&ifr.ifr_ifru.ifru_addr)->sin_addr);
-    return 0;
-}
-
-int if_setmtu(const char *name, int mtu) {
-    struct ifreq ifr;
-    memset(&ifr, 0, sizeof(ifr));
-
-    strcpy(ifr.ifr_name, name);
-    ifr.ifr_ifru.ifru_mtu = mtu;
-    return if_ioctl(SIOCSIFMTU, &ifr);
-}
-
-int if_getmtu(const char *name) {
-    int err;
-    struct ifreq ifr;
-    memset(&ifr, 0, sizeof(ifr));
-
-    strcpy(ifr.ifr_name, name);
-    if ((err = if_ioctl(SIOCGIFMTU, &ifr)) < 0) {
-        return err;
-    }
-
-    return ifr.ifr_ifru.ifru_mtu;
-}
-
-int if_up(const char *name) {
-    int err;
-    struct ifreq ifr;
-    memset(&ifr, 0, sizeof(ifr));
-
-    strcpy(ifr.ifr_name, name);
-    if ((err = if_ioctl(SIOCGIFFLAGS, &ifr)) < 0) {
-        return err;
-    }
-    if (!(ifr.ifr_flags & IFF_UP)) {
-        ifr.ifr_flags |= IFF_UP;
-        return if_ioctl(SIOCSIFFLAGS, &ifr) < 0;
-    }
-    return 0;
-}
-
-int if_down(const char *name) {
-    int err;
-    struct ifreq ifr;
-    memset(&ifr, 0, sizeof(ifr));
-
-    strcpy(ifr.ifr_name, name);
-    if ((err = if_ioctl(SIOCGIFFLAGS, &ifr)) < 0) {
-        return err;
-    }
-    if (ifr.ifr_flags & IFF_UP) {
-        ifr.ifr_flags &= ~IFF_UP;
-        return if_ioctl(SIOCSIFFLAGS, &ifr) < 0;
-    }
-    return 0;
-}
-
-*/
-import "C"
+package secretun
 
 import (
-	"fmt"
+	"encoding/binary"
+	"errors"
 	"log"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"unsafe"
 )
 
 const TUN_DEV = "/dev/net/tun"
 
+// IFF_MULTI_QUEUE, not in package syscall
+const iffMultiQueue = 0x0100
+
+// Tun is a tun device with one or more queues. The kernel spreads the
+// packets it hands us over the queues by flow, and we write every flow to
+// the queue of its own, so packets of one flow keep their order while the
+// queues run in parallel.
 type Tun struct {
-	Name string
-	file *os.File
+	Name   string
+	Index  int
+	files  []*os.File
+	writes []chan *Packet
+	closed chan struct{}
+	// close_once makes a second Close a no-op
+	close_once sync.Once
+	// mtu sizes the buffers ReadChan reads into, SetMTU keeps it current
+	mtu atomic.Int32
 }
 
-func CreateTun(name string) (*Tun, error) {
-	f, err := os.OpenFile(TUN_DEV, os.O_RDWR, 0)
-	if err != nil {
-		return nil, err
+type ifreq struct {
+	Name [syscall.IFNAMSIZ]byte
+	Data [24]byte
+}
+
+func newIfreq(name string) *ifreq {
+	ifr := new(ifreq)
+	copy(ifr.Name[:syscall.IFNAMSIZ-1], name)
+	return ifr
+}
+
+func (ifr *ifreq) name() string {
+	for i, c := range ifr.Name {
+		if c == 0 {
+			return string(ifr.Name[:i])
+		}
 	}
+	return string(ifr.Name[:])
+}
 
-	cbuf := (*C.char)(C.malloc(C.IFNAMSIZ))
-	defer C.free(unsafe.Pointer(cbuf))
-	C.memset(unsafe.Pointer(cbuf), 0, C.IFNAMSIZ)
-	c_name := C.CString(name)
-	defer C.free(unsafe.Pointer(c_name))
+func (ifr *ifreq) setUint16(v uint16) {
+	binary.NativeEndian.PutUint16(ifr.Data[0:2], v)
+}
 
-	C.strncpy(cbuf, c_name, C.IFNAMSIZ-1)
+func (ifr *ifreq) int32() int32 {
+	return int32(binary.NativeEndian.Uint32(ifr.Data[0:4]))
+}
 
-	if C.create_tun(C.int(f.Fd()), cbuf) < 0 {
-		return nil, fmt.Errorf("create tun fail")
+// the union holds a struct sockaddr_in for the address requests
+func (ifr *ifreq) setAddr(ip net.IP) error {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return os.NewSyscallError("ioctl", syscall.EAFNOSUPPORT)
 	}
+	binary.NativeEndian.PutUint16(ifr.Data[0:2], syscall.AF_INET)
+	copy(ifr.Data[4:8], ip4)
+	return nil
+}
 
-	return &Tun{C.GoString(cbuf), f}, nil
+func (ifr *ifreq) addr() net.IP {
+	ip := make(net.IP, 4)
+	copy(ip, ifr.Data[4:8])
+	return ip
 }
 
-func (t *Tun) Close() error {
-	t.Down()
-	return t.file.Close()
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
 }
 
-func (t *Tun) SetSelfAddr(ip net.IP) error {
-	c_name, c_addr := C.CString(t.Name), C.CString(ip.String())
-	defer C.free(unsafe.Pointer(c_name))
-	defer C.free(unsafe.Pointer(c_addr))
+func ifIoctl(name string, req uintptr, ifr *ifreq) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
 
-	if C.if_setaddr(C.SIOCSIFADDR, c_name, c_addr) < 0 {
-		return fmt.Errorf("set addr fail")
+	if err := ioctl(uintptr(fd), req, unsafe.Pointer(ifr)); err != nil {
+		return os.NewSyscallError("ioctl "+name, err)
 	}
 	return nil
 }
 
-func (t *Tun) GetSelfAddr() (ip net.IP, err error) {
-	var c_addr *C.char
-	c_name := C.CString(t.Name)
-	defer C.free(unsafe.Pointer(c_name))
-	if C.if_getaddr(C.SIOCGIFADDR, c_name, &c_addr) < 0 {
-		err = fmt.Errorf("get self addr fail")
-		return
+func ifIndex(name string) (int, error) {
+	ifr := newIfreq(name)
+	if err := ifIoctl("SIOCGIFINDEX", syscall.SIOCGIFINDEX, ifr); err != nil {
+		return 0, err
 	}
-	return net.ParseIP(C.GoString(c_addr)), nil
+	return int(ifr.int32()), nil
 }
 
-func (t *Tun) SetDestAddr(ip net.IP) error {
-	c_name, c_addr := C.CString(t.Name), C.CString(ip.String())
-	defer C.free(unsafe.Pointer(c_name))
-	defer C.free(unsafe.Pointer(c_addr))
+func CreateTun(name string) (*Tun, error) {
+	return CreateTunQueues(name, 1)
+}
 
-	if C.if_setaddr(C.SIOCSIFDSTADDR, c_name, c_addr) < 0 {
-		return fmt.Errorf("set dest addr fail")
+// openQueue attaches a new fd to the interface name, or creates one
+func openQueue(name string, flags uint16) (*os.File, string, error) {
+	// attach the interface before the fd reaches the runtime poller, and
+	// never call f.Fd(): a file in blocking mode can't be interrupted by
+	// Close, which leaked the fd and the interface along with it
+	fd, err := syscall.Open(TUN_DEV, os.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", &os.PathError{Op: "open", Path: TUN_DEV, Err: err}
 	}
-	return nil
+
+	ifr := newIfreq(name)
+	ifr.setUint16(flags)
+	if err := ioctl(uintptr(fd), syscall.TUNSETIFF, unsafe.Pointer(ifr)); err != nil {
+		syscall.Close(fd)
+		return nil, "", os.NewSyscallError("ioctl TUNSETIFF", err)
+	}
+	return os.NewFile(uintptr(fd), TUN_DEV), ifr.name(), nil
 }
 
-func (t *Tun) GetDestAddr() (ip net.IP, err error) {
-	var c_addr *C.char
-	c_name := C.CString(t.Name)
-	defer C.free(unsafe.Pointer(c_name))
-	if C.if_getaddr(C.SIOCGIFDSTADDR, c_name, &c_addr) < 0 {
-		err = fmt.Errorf("get dest addr fail")
-		return
+// CreateTunQueues creates a tun with that many queues, each with a reader
+// in ReadChan and a writer for Send
+func CreateTunQueues(name string, queues int) (*Tun, error) {
+	flags := uint16(syscall.IFF_TUN | syscall.IFF_NO_PI)
+	if queues > 1 {
+		flags |= iffMultiQueue
 	}
-	return net.ParseIP(C.GoString(c_addr)), nil
+
+	t := &Tun{Name: name, closed: make(chan struct{})}
+	for i := 0; i < max(queues, 1); i++ {
+		f, name, err := openQueue(t.Name, flags)
+		if err != nil {
+			t.closeFiles()
+			return nil, err
+		}
+		t.Name = name
+		t.files = append(t.files, f)
+	}
+
+	var err error
+	if t.Index, err = ifIndex(t.Name); err != nil {
+		t.closeFiles()
+		return nil, err
+	}
+	if len(t.files) > 1 {
+		for _, f := range t.files {
+			ch := make(chan *Packet, packetQueueSize)
+			t.writes = append(t.writes, ch)
+			go t.writeQueue(f, ch)
+		}
+	}
+	return t, nil
+}
+
+func (t *Tun) closeFiles() (err error) {
+	for _, f := range t.files {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+func (t *Tun) Close() (err error) {
+	t.close_once.Do(func() {
+		t.Down()
+		close(t.closed)
+		err = t.closeFiles()
+	})
+	return
+}
+
+func (t *Tun) setAddr(name string, req uintptr, ip net.IP) error {
+	ifr := newIfreq(t.Name)
+	if err := ifr.setAddr(ip); err != nil {
+		return err
+	}
+	return ifIoctl(name, req, ifr)
+}
+
+func (t *Tun) getAddr(name string, req uintptr) (net.IP, error) {
+	ifr := newIfreq(t.Name)
+	if err := ifIoctl(name, req, ifr); err != nil {
+		return nil, err
+	}
+	return ifr.addr(), nil
+}
+
+func (t *Tun) SetSelfAddr(ip net.IP) error {
+	return t.setAddr("SIOCSIFADDR", syscall.SIOCSIFADDR, ip)
+}
+
+func (t *Tun) GetSelfAddr() (ip net.IP, err error) {
+	return t.getAddr("SIOCGIFADDR", syscall.SIOCGIFADDR)
+}
+
+func (t *Tun) SetDestAddr(ip net.IP) error {
+	return t.setAddr("SIOCSIFDSTADDR", syscall.SIOCSIFDSTADDR, ip)
+}
+
+func (t *Tun) GetDestAddr() (ip net.IP, err error) {
+	return t.getAddr("SIOCGIFDSTADDR", syscall.SIOCGIFDSTADDR)
 }
 
 func (t *Tun) SetAddr(self net.IP, dest net.IP) error {
@@ -223,97 +224,298 @@ func (t *Tun) SetAddr(self net.IP, dest net.IP) error {
 }
 
 func (t *Tun) SetNetmask(mask net.IPMask) error {
-	c_name, c_mask := C.CString(t.Name), C.CString(net.IP(mask).String())
-	defer C.free(unsafe.Pointer(c_name))
-	defer C.free(unsafe.Pointer(c_mask))
-
-	if C.if_setaddr(C.SIOCSIFNETMASK, c_name, c_mask) < 0 {
-		return fmt.Errorf("set netmask fail")
-	}
-	return nil
+	return t.setAddr("SIOCSIFNETMASK", syscall.SIOCSIFNETMASK, net.IP(mask))
 }
 
 func (t *Tun) GetNetmask() (mask net.IPMask, err error) {
-	var c_addr *C.char
-	c_name := C.CString(t.Name)
-	defer C.free(unsafe.Pointer(c_name))
-	if C.if_getaddr(C.SIOCGIFNETMASK, c_name, &c_addr) < 0 {
-		err = fmt.Errorf("get netmask fail")
-		return
+	ip, err := t.getAddr("SIOCGIFNETMASK", syscall.SIOCGIFNETMASK)
+	return net.IPMask(ip), err
+}
+
+func (t *Tun) SetAddr6(ip net.IP, prefix int) error {
+	return t.AddAddr(net.IPNet{IP: ip, Mask: net.CIDRMask(prefix, 128)}, nil)
+}
+
+func ifAddrRequest(typ, flags int, index int, addr net.IPNet, peer net.IP) *netlinkRequest {
+	family, ip := syscall.AF_INET, addr.IP.To4()
+	if ip == nil {
+		family, ip = syscall.AF_INET6, addr.IP.To16()
 	}
-	return net.IPMask(net.ParseIP(C.GoString(c_addr))), nil
+	ones, _ := addr.Mask.Size()
+
+	msg := syscall.IfAddrmsg{
+		Family:    uint8(family),
+		Prefixlen: uint8(ones),
+		Index:     uint32(index),
+	}
+	if family == syscall.AF_INET6 {
+		msg.Flags = syscall.IFA_F_NODAD
+	}
+
+	req := newNetlinkRequest(typ, flags, unsafe.Pointer(&msg), syscall.SizeofIfAddrmsg)
+	req.addAttr(syscall.IFA_LOCAL, ip)
+	if peer == nil {
+		req.addAttr(syscall.IFA_ADDRESS, ip)
+	} else if family == syscall.AF_INET {
+		req.addAttr(syscall.IFA_ADDRESS, peer.To4())
+	} else {
+		req.addAttr(syscall.IFA_ADDRESS, peer.To16())
+	}
+	return req
 }
 
-func (t *Tun) SetMTU(mtu int) error {
-	c_name := C.CString(t.Name)
-	defer C.free(unsafe.Pointer(c_name))
+// AddAddr adds another address to the interface, peer is optional and
+// makes it a point-to-point address.
+func (t *Tun) AddAddr(addr net.IPNet, peer net.IP) error {
+	req := ifAddrRequest(syscall.RTM_NEWADDR,
+		syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK,
+		t.Index, addr, peer)
+	_, err := req.Execute()
+	return err
+}
+
+func (t *Tun) DelAddr(addr net.IPNet) error {
+	req := ifAddrRequest(syscall.RTM_DELADDR, syscall.NLM_F_ACK, t.Index, addr, nil)
+	_, err := req.Execute()
+	return err
+}
 
-	if C.if_setmtu(c_name, C.int(mtu)) < 0 {
-		return fmt.Errorf("set mtu fail")
+func (t *Tun) Addrs() ([]net.IPNet, error) {
+	msg := syscall.IfAddrmsg{Family: syscall.AF_UNSPEC}
+	req := newNetlinkRequest(syscall.RTM_GETADDR, syscall.NLM_F_DUMP,
+		unsafe.Pointer(&msg), syscall.SizeofIfAddrmsg)
+	replies, err := req.Execute()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+
+	var addrs []net.IPNet
+	for _, m := range replies {
+		if m.Header.Type != syscall.RTM_NEWADDR || len(m.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		ifa := (*syscall.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+		if int(ifa.Index) != t.Index {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return nil, err
+		}
+
+		var ip net.IP
+		for _, a := range attrs {
+			if a.Attr.Type == syscall.IFA_LOCAL || (ip == nil && a.Attr.Type == syscall.IFA_ADDRESS) {
+				ip = net.IP(append([]byte(nil), a.Value...))
+			}
+		}
+		if ip != nil {
+			addrs = append(addrs, net.IPNet{IP: ip, Mask: net.CIDRMask(int(ifa.Prefixlen), len(ip)*8)})
+		}
+	}
+	return addrs, nil
 }
 
-func (t *Tun) GetMTU() (int, error) {
-	c_name := C.CString(t.Name)
-	defer C.free(unsafe.Pointer(c_name))
+func routeRequest(typ, flags int, dst net.IPNet, gw net.IP, index int) *netlinkRequest {
+	family, ip := syscall.AF_INET, dst.IP.To4()
+	if ip == nil {
+		family, ip = syscall.AF_INET6, dst.IP.To16()
+	}
+	ones, _ := dst.Mask.Size()
+
+	msg := syscall.RtMsg{
+		Family:   uint8(family),
+		Dst_len:  uint8(ones),
+		Table:    syscall.RT_TABLE_MAIN,
+		Protocol: syscall.RTPROT_BOOT,
+		Scope:    syscall.RT_SCOPE_LINK,
+		Type:     syscall.RTN_UNICAST,
+	}
+	if gw != nil {
+		msg.Scope = syscall.RT_SCOPE_UNIVERSE
+	}
 
-	if mtu := int(C.if_getmtu(c_name)); mtu < 0 {
-		return 0, fmt.Errorf("get mtu fail")
-	} else {
-		return mtu, nil
+	req := newNetlinkRequest(typ, flags, unsafe.Pointer(&msg), syscall.SizeofRtMsg)
+	if ones > 0 {
+		req.addAttr(syscall.RTA_DST, ip)
+	}
+	if gw != nil {
+		if family == syscall.AF_INET {
+			req.addAttr(syscall.RTA_GATEWAY, gw.To4())
+		} else {
+			req.addAttr(syscall.RTA_GATEWAY, gw.To16())
+		}
 	}
-	return 0, nil
+	if index > 0 {
+		req.addUint32(syscall.RTA_OIF, uint32(index))
+	}
+	return req
 }
 
-func (t *Tun) Up() error {
-	c_name := C.CString(t.Name)
-	defer C.free(unsafe.Pointer(c_name))
+func route(typ, flags int, dst net.IPNet, gw net.IP, dev string) (err error) {
+	index := 0
+	if len(dev) > 0 {
+		if index, err = ifIndex(dev); err != nil {
+			return
+		}
+	}
+	_, err = routeRequest(typ, flags, dst, gw, index).Execute()
+	return
+}
+
+func AddRoute(dst net.IPNet, gw net.IP, dev string) error {
+	return route(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK, dst, gw, dev)
+}
+
+func DelRoute(dst net.IPNet, gw net.IP, dev string) error {
+	return route(syscall.RTM_DELROUTE, syscall.NLM_F_ACK, dst, gw, dev)
+}
 
-	if C.if_up(c_name) < 0 {
-		return fmt.Errorf("if up fail")
+func (t *Tun) AddRoute(dst net.IPNet) error {
+	return AddRoute(dst, nil, t.Name)
+}
+
+func (t *Tun) DelRoute(dst net.IPNet) error {
+	return DelRoute(dst, nil, t.Name)
+}
+
+func (t *Tun) setLink(flags, change uint32, attrs func(*netlinkRequest)) error {
+	msg := syscall.IfInfomsg{
+		Family: syscall.AF_UNSPEC,
+		Index:  int32(t.Index),
+		Flags:  flags,
+		Change: change,
 	}
-	return nil
+	req := newNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_ACK,
+		unsafe.Pointer(&msg), syscall.SizeofIfInfomsg)
+	if attrs != nil {
+		attrs(req)
+	}
+	_, err := req.Execute()
+	return err
 }
 
-func (t *Tun) Down() error {
-	c_name := C.CString(t.Name)
-	defer C.free(unsafe.Pointer(c_name))
+func (t *Tun) SetMTU(mtu int) error {
+	err := t.setLink(0, 0, func(req *netlinkRequest) {
+		req.addUint32(syscall.IFLA_MTU, uint32(mtu))
+	})
+	if err == nil {
+		t.mtu.Store(int32(mtu))
+	}
+	return err
+}
 
-	if C.if_down(c_name) < 0 {
-		return fmt.Errorf("if down fail")
+func (t *Tun) GetMTU() (int, error) {
+	ifr := newIfreq(t.Name)
+	if err := ifIoctl("SIOCGIFMTU", syscall.SIOCGIFMTU, ifr); err != nil {
+		return 0, err
 	}
-	return nil
+	return int(ifr.int32()), nil
 }
 
+func (t *Tun) SetTxQueueLen(qlen int) error {
+	return t.setLink(0, 0, func(req *netlinkRequest) {
+		req.addUint32(syscall.IFLA_TXQLEN, uint32(qlen))
+	})
+}
+
+func (t *Tun) Up() error {
+	return t.setLink(syscall.IFF_UP, syscall.IFF_UP, nil)
+}
+
+func (t *Tun) Down() error {
+	return t.setLink(0, syscall.IFF_UP, nil)
+}
+
+// Read and Write use the first queue
 func (t *Tun) Read(p []byte) (int, error) {
-	return t.file.Read(p)
+	return t.files[0].Read(p)
 }
 
 func (t *Tun) Write(p []byte) (n int, err error) {
-	return t.file.Write(p)
+	return t.files[0].Write(p)
+}
+
+// Send writes a PT_P2P packet and releases it. With several queues it only
+// queues p for the writer of its flow, which logs errors itself.
+func (t *Tun) Send(p *Packet) error {
+	if len(t.writes) == 0 {
+		_, err := t.Write(p.Data)
+		p.Release()
+		return err
+	}
+
+	select {
+	case t.writes[flowHash(p.Data)%uint32(len(t.writes))] <- p:
+	case <-t.closed:
+		p.Release()
+	}
+	return nil
+}
+
+func (t *Tun) writeQueue(f *os.File, ch chan *Packet) {
+	for {
+		select {
+		case p := <-ch:
+			if _, err := f.Write(p.Data); err != nil && !errors.Is(err, os.ErrClosed) {
+				log.Println("write tun:", err)
+			}
+			p.Release()
+		case <-t.closed:
+			return
+		}
+	}
 }
 
-func (t *Tun) ReadChan() (chan []byte, error) {
-	ch := make(chan []byte)
+// ReadChan reads PT_P2P packets from every queue, with room in front for
+// the headers, until the tun is closed. Whoever consumes a packet
+// releases it.
+func (t *Tun) ReadChan() (chan *Packet, error) {
+	ch := make(chan *Packet, packetQueueSize)
 	mtu, err := t.GetMTU()
 	if err != nil {
 		return nil, err
 	}
-
-	buf := make([]byte, mtu*2)
-	go func() {
-		defer close(ch)
-		for {
-			if n, err := t.Read(buf); err != nil {
-				log.Println("read tun fail:", err)
-				return
-			} else {
-				snd := make([]byte, n)
-				copy(snd, buf[:n])
-				ch <- snd
+	t.mtu.Store(int32(mtu))
+
+	var readers sync.WaitGroup
+	for _, f := range t.files {
+		readers.Add(1)
+		go func(f *os.File) {
+			defer readers.Done()
+			for {
+				// one byte over the mtu tells a packet the kernel cut
+				// short, after the mtu was raised behind our back
+				size := int(t.mtu.Load()) + 1
+				p := getPacket(size)
+				n, err := f.Read(p.Data)
+				if errors.Is(err, os.ErrClosed) {
+					return
+				} else if err != nil {
+					log.Println("read tun fail:", err)
+					return
+				}
+
+				if n == size {
+					p.Release()
+					if mtu, err := t.GetMTU(); err == nil && mtu >= size {
+						log.Printf("%s: mtu changed to %d", t.Name, mtu)
+						t.mtu.Store(int32(mtu))
+					}
+					continue
+				}
+				p.Data = p.Data[:n]
+				select {
+				case ch <- p:
+				case <-t.closed:
+					return
+				}
 			}
-		}
+		}(f)
+	}
+	go func() {
+		readers.Wait()
+		close(ch)
 	}()
 
 	return ch, err
@@ -3,14 +3,32 @@ package secretun
 import (
 	"fmt"
 	"net"
+	"sync"
+	"time"
 )
 
+type lease struct {
+	user   string
+	expire time.Time
+}
+
+// pools larger than this many host bits (IPv6 /64s) only hand out
+// the low end of the range, addresses past it are refused
+const maxHostBits = 24
+
 type IPPool struct {
 	Gateway net.IP
 	IPNet   *net.IPNet
+	Grace   time.Duration
 	last    uint
 	gw_idx  uint
 	max     uint
+	v4      bool
+
+	lock     sync.Mutex
+	used     map[uint]string
+	released map[uint]lease
+	pinned   map[uint]string
 }
 
 func get_gw_idx(gw net.IP, mask net.IPMask) uint {
@@ -28,7 +46,8 @@ func get_gw_idx(gw net.IP, mask net.IPMask) uint {
 	return idx
 }
 
-func NewIPPool(cidr string, gw string) (p IPPool, err error) {
+func NewIPPool(cidr string, gw string) (p *IPPool, err error) {
+	p = new(IPPool)
 	p.Gateway = net.ParseIP(gw)
 	if _, p.IPNet, err = net.ParseCIDR(cidr); err != nil {
 		return
@@ -36,36 +55,171 @@ func NewIPPool(cidr string, gw string) (p IPPool, err error) {
 	if !p.IPNet.Contains(p.Gateway) {
 		err = fmt.Errorf("invalid gateway or net")
 	}
-	ones, _ := p.IPNet.Mask.Size()
-	p.max = (1 << uint(32-ones)) - 1
+	ones, bits := p.IPNet.Mask.Size()
+	host := uint(bits - ones)
+	if host > maxHostBits {
+		host = maxHostBits
+	}
+	p.max = (1 << host) - 1
+	p.v4 = p.IPNet.IP.To4() != nil
 	p.last = 0
 	p.gw_idx = get_gw_idx(p.Gateway, p.IPNet.Mask)
+	if !p.ip(p.gw_idx).Equal(p.Gateway) {
+		// past the range of a uint, it can't collide with a pool address
+		p.gw_idx = 0
+	}
+	p.used = map[uint]string{}
+	p.released = map[uint]lease{}
+	p.pinned = map[uint]string{}
 
 	return
 }
 
-func (p *IPPool) Next() (ip net.IP) {
-	for p.last < p.max {
-		p.last += 1
-		idx := p.last
-		if idx&0xFF == 0xFF || idx&0xFF == 0 || idx == p.gw_idx {
-			continue
+func (p *IPPool) ip(idx uint) net.IP {
+	ip := make([]byte, len(p.IPNet.IP))
+	copy(ip, p.IPNet.IP)
+	pos := len(ip) - 1
+	for idx > 0 {
+		ip[pos] |= byte(idx & 0xFF)
+		idx >>= 8
+		pos -= 1
+	}
+	return ip
+}
+
+func (p *IPPool) available(idx uint, now time.Time) bool {
+	if idx == 0 || idx == p.gw_idx {
+		return false
+	}
+	if p.v4 && (idx&0xFF == 0xFF || idx&0xFF == 0) {
+		return false
+	}
+	if _, ok := p.used[idx]; ok {
+		return false
+	}
+	if _, ok := p.pinned[idx]; ok {
+		return false
+	}
+	if l, ok := p.released[idx]; ok {
+		if now.Before(l.expire) {
+			return false
+		}
+		delete(p.released, idx)
+	}
+	return true
+}
+
+func (p *IPPool) find(user string, now time.Time) uint {
+	for idx, l := range p.released {
+		if l.user == user && now.Before(l.expire) {
+			delete(p.released, idx)
+			return idx
 		}
+	}
 
-		ip = make([]byte, len(p.IPNet.IP))
-		copy(ip, p.IPNet.IP)
-		pos := len(ip) - 1
-		for idx > 0 {
-			ip[pos] |= byte(idx & 0xFF)
-			idx >>= 8
-			pos -= 1
+	for i := uint(0); i < p.max; i++ {
+		idx := (p.last+i)%p.max + 1
+		if p.available(idx, now) {
+			return idx
 		}
-		break
 	}
+	return 0
+}
 
-	return
+func (p *IPPool) Next(user string) net.IP {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	idx := p.find(user, time.Now())
+	if idx == 0 {
+		return nil
+	}
+	p.used[idx] = user
+	p.last = idx
+	return p.ip(idx)
+}
+
+func (p *IPPool) index(ip net.IP) (uint, error) {
+	if ip == nil || !p.IPNet.Contains(ip) {
+		return 0, fmt.Errorf("%s not in %s", ip, p.IPNet)
+	}
+	// get_gw_idx drops the host bits that don't fit a uint, e.g. in an
+	// IPv6 net shorter than /64, so the index has to lead back to ip
+	idx := get_gw_idx(ip, p.IPNet.Mask)
+	if idx == 0 || idx >= p.max || idx == p.gw_idx || !p.ip(idx).Equal(ip) {
+		return 0, fmt.Errorf("%s is reserved or out of pool range", ip)
+	}
+	return idx, nil
 }
 
-func (p *IPPool) IsEmpty() bool {
-	return p.last == p.max
+// pinIndexes checks pins, address by user, for setPinned
+func (p *IPPool) pinIndexes(pins map[string]net.IP) (map[uint]string, error) {
+	pinned := map[uint]string{}
+	for user, ip := range pins {
+		idx, err := p.index(ip)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %v", user, err)
+		}
+		if owner, ok := pinned[idx]; ok {
+			return nil, fmt.Errorf("user %s: %s already pinned to %s", user, ip, owner)
+		}
+		pinned[idx] = user
+	}
+	return pinned, nil
+}
+
+// setPinned replaces every pinned address, addresses in use stay with
+// their users until released
+func (p *IPPool) setPinned(pinned map[uint]string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.pinned = pinned
+}
+
+func (p *IPPool) SetGrace(grace time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.Grace = grace
+}
+
+func (p *IPPool) Take(ip net.IP, user string) error {
+	idx, err := p.index(ip)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if owner, ok := p.pinned[idx]; ok && owner != user {
+		return fmt.Errorf("%s pinned to another user", ip)
+	}
+	if _, ok := p.used[idx]; ok {
+		return fmt.Errorf("%s in use", ip)
+	}
+	delete(p.released, idx)
+	p.used[idx] = user
+	return nil
+}
+
+func (p *IPPool) Release(ip net.IP) {
+	if ip == nil || !p.IPNet.Contains(ip) {
+		return
+	}
+	idx := get_gw_idx(ip, p.IPNet.Mask)
+	if !p.ip(idx).Equal(ip) {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	user, ok := p.used[idx]
+	if !ok {
+		return
+	}
+	delete(p.used, idx)
+	if _, ok := p.pinned[idx]; !ok && p.Grace > 0 {
+		p.released[idx] = lease{user, time.Now().Add(p.Grace)}
+	}
 }
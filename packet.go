@@ -1,8 +1,7 @@
 package secretun
 
 import (
-	"bytes"
-	"encoding/gob"
+	"fmt"
 )
 
 const (
@@ -10,53 +9,97 @@ const (
 	PT_P2P = iota
 	PT_AUTH
 	PT_SHUTDOWN
+	PT_KEX
+	PT_CHALLENGE
+	PT_PING
+	PT_PONG
+	PT_HELLO
 	PT_UNKNOWN
 )
 
+var (
+	// errShutdown ends a connection because we are shutting down, the peer
+	// gets a PT_SHUTDOWN
+	errShutdown = fmt.Errorf("shutting down")
+	// errPeerShutdown ends a connection the peer sent PT_SHUTDOWN on
+	errPeerShutdown = fmt.Errorf("peer shut down")
+)
+
 type Packet struct {
 	Type uint8
 	Data []byte
-}
 
-var encoders Encoders
+	// buf is the pooled buffer Data lives in, if any
+	buf []byte
+}
 
-func (p *Packet) Decode(e interface{}) error {
-	buf := bytes.NewBuffer(p.Data)
-	de := gob.NewDecoder(buf)
-	return de.Decode(e)
+// Release gives the buffer of p back to the pool once p is no longer
+// needed, packets that don't have one are left to the garbage collector
+func (p *Packet) Release() {
+	if p.buf != nil {
+		putBuffer(p.buf)
+		p.buf, p.Data = nil, nil
+	}
 }
 
-func (p *Packet) Encode(e interface{}) error {
-	buf := new(bytes.Buffer)
-	en := gob.NewEncoder(buf)
-	if err := en.Encode(e); err != nil {
-		return err
+// flow is the flowHash of data packets, control packets all share flow 0
+func (p *Packet) flow() uint32 {
+	if p.Type != PT_P2P {
+		return 0
 	}
-	p.Data = buf.Bytes()
-	return nil
+	return flowHash(p.Data)
 }
 
-func (p *Packet) Serialize() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	if err := buf.WriteByte(p.Type); err != nil {
-		return nil, err
+// headroom is the offset of Data in buf, 0 if Data is somewhere else
+func (p *Packet) headroom() int {
+	if p.buf == nil || len(p.Data) == 0 {
+		return 0
 	}
-	if _, err := buf.Write(p.Data); err != nil {
-		return nil, err
+	off := cap(p.buf) - cap(p.Data)
+	if off <= 0 || off >= len(p.buf) || &p.buf[off] != &p.Data[0] {
+		return 0
 	}
-	return encoders.Encode(buf.Bytes())
+	return off
+}
+
+// Decode reads the control message in p into e, see unmarshalMessage
+func (p *Packet) Decode(e interface{}) error {
+	return unmarshalMessage(p.Data, e)
+}
+
+// Encode makes e, a control message, the payload of p
+func (p *Packet) Encode(e interface{}) (err error) {
+	p.Data, err = marshalMessage(e)
+	return
+}
+
+// serialize puts the type byte in front of Data, in place when p has a
+// buffer with room in front of Data, and into a new one with packetHeadroom
+// otherwise. The result is buf[off:], the bytes before off and behind
+// len(buf) up to cap(buf) are free for headers and trailers. Data is
+// overwritten as the frame is sealed.
+func (p *Packet) serialize() (buf []byte, off int) {
+	if off = p.headroom(); off > 0 {
+		buf = p.buf[:off+len(p.Data)]
+		buf[off-1] = p.Type
+		return buf, off - 1
+	}
+
+	size := packetHeadroom + 1 + len(p.Data)
+	buf = make([]byte, size, size+packetTailroom)
+	buf[packetHeadroom] = p.Type
+	copy(buf[packetHeadroom+1:], p.Data)
+	return buf, packetHeadroom
 }
 
 func DeserializePacket(data []byte) (*Packet, error) {
-	if decoded_data, err := encoders.Decode(data); err != nil {
-		return nil, err
-	} else {
-		p := new(Packet)
-		p.Type = decoded_data[0]
-		p.Data = decoded_data[1:]
-		return p, nil
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty packet")
 	}
-	return nil, nil
+	p := new(Packet)
+	p.Type = data[0]
+	p.Data = data[1:]
+	return p, nil
 }
 
 func NewPacket(t uint8, e interface{}) (pack *Packet) {
@@ -74,15 +117,157 @@ func NewPacket(t uint8, e interface{}) (pack *Packet) {
 	return pack
 }
 
-func InitPacket(cfg Config) (err error) {
+// packetConfig is the "packet" section. Connections get their own encoder
+// instances from it, so encoders may keep per-session state. workers is
+// how many goroutines encode and decode for each connection, stream names
+// the first StreamEncoder, if any. keyed is set if packets are sealed with
+// a pre-shared key, whether key or an aead encoder, those bind to the hello.
+type packetConfig struct {
+	names    []string
+	encoders map[string]Config
+	params   map[string]map[string]string
+	optional map[string]bool
+	psk      []byte
+	workers  int
+	stream   string
+	keyed    bool
+}
+
+func newPacketConfig(cfg Config) (pc *packetConfig, err error) {
 	var encoders_cfg []Config
-	if err := cfg.Get("encoders", &encoders_cfg); err != nil {
-		return err
+	if err = cfg.Get("encoders", &encoders_cfg); err != nil {
+		return
+	}
+
+	pc = &packetConfig{
+		encoders: map[string]Config{},
+		params:   map[string]map[string]string{},
+		optional: map[string]bool{},
+		workers:  1,
+	}
+	if err = cfg.GetOptional("workers", &pc.workers); err != nil {
+		return nil, err
+	} else if pc.workers < 1 {
+		return nil, fmt.Errorf("packet: workers must be at least 1")
+	}
+	for _, encoder_cfg := range encoders_cfg {
+		var name string
+		if err = encoder_cfg.Get("name", &name); err != nil {
+			return nil, err
+		} else if _, ok := pc.encoders[name]; ok {
+			return nil, fmt.Errorf("duplicate encoder: %s", name)
+		}
+		pc.names = append(pc.names, name)
+		pc.encoders[name] = encoder_cfg
+		pc.optional[name] = encoder_cfg.GetBool("optional")
+	}
+
+	// catch configuration errors at startup
+	encoders, err := GetEncoders(encoders_cfg)
+	if err != nil {
+		return nil, err
+	}
+	for i, encoder := range encoders {
+		if p, ok := encoder.(EncoderParams); ok {
+			pc.params[pc.names[i]] = p.Params()
+		}
+		if _, ok := encoder.(binder); ok {
+			pc.keyed = true
+		}
+		if _, ok := encoder.(StreamEncoder); ok && len(pc.stream) == 0 {
+			pc.stream = pc.names[i]
+		}
+	}
+	if len(pc.stream) > 0 && pc.workers > 1 {
+		return nil, fmt.Errorf("packet: encoder %s needs packets in order, workers must be 1", pc.stream)
 	}
 
-	if encoders, err = GetEncoders(encoders_cfg); err != nil {
-		return err
+	if cfg.Has("key") || cfg.Has("key_file") {
+		psk := &AEADEncoder{}
+		if err = psk.Init(cfg); err != nil {
+			return nil, err
+		}
+		pc.psk = psk.key
+		pc.keyed = true
 	}
+	return pc, nil
+}
 
+// checkTunnel fails if a stream encoder would run over a tunnel that may
+// lose or reorder packets
+func (pc *packetConfig) checkTunnel(tunnel interface{}) error {
+	if _, ok := tunnel.(datagramTunnel); ok && len(pc.stream) > 0 {
+		return fmt.Errorf("packet: encoder %s needs an ordered tunnel, not udp", pc.stream)
+	}
 	return nil
 }
+
+// offers lists the configured encoders for the server to choose from
+func (pc *packetConfig) offers() []EncoderOffer {
+	offers := make([]EncoderOffer, 0, len(pc.names))
+	for _, name := range pc.names {
+		offers = append(offers, EncoderOffer{name, pc.params[name]})
+	}
+	return offers
+}
+
+func paramsMismatch(ours, theirs map[string]string) string {
+	for k, v := range ours {
+		if theirs[k] != v {
+			return fmt.Sprintf("%s is %q on the client but %q on the server", k, theirs[k], v)
+		}
+	}
+	return ""
+}
+
+// choose keeps the configured encoders, in our order, that the client
+// offered with matching parameters. Leaving one out is an error unless it
+// is marked optional.
+func (pc *packetConfig) choose(offers []EncoderOffer) ([]string, error) {
+	offered := map[string]EncoderOffer{}
+	for _, o := range offers {
+		offered[o.Name] = o
+	}
+
+	names := make([]string, 0, len(pc.names))
+	for _, name := range pc.names {
+		var reason string
+		if o, ok := offered[name]; !ok {
+			reason = "not supported by the client"
+		} else {
+			reason = paramsMismatch(pc.params[name], o.Params)
+		}
+
+		if len(reason) == 0 {
+			names = append(names, name)
+		} else if !pc.optional[name] {
+			return nil, fmt.Errorf("encoder %s: %s", name, reason)
+		}
+	}
+	return names, nil
+}
+
+// build makes a fresh chain of the named encoders
+func (pc *packetConfig) build(names []string) (Encoders, error) {
+	cfgs := make([]Config, 0, len(names))
+	for _, name := range names {
+		cfg, ok := pc.encoders[name]
+		if !ok {
+			return nil, fmt.Errorf("encoder %s is not configured", name)
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return GetEncoders(cfgs)
+}
+
+// seal is the pre-shared key sealing for one connection, nil without a key
+func (pc *packetConfig) seal() (*AEADEncoder, error) {
+	if pc.psk == nil {
+		return nil, nil
+	}
+	psk := &AEADEncoder{}
+	if err := psk.SetKey(pc.psk); err != nil {
+		return nil, err
+	}
+	return psk, nil
+}
@@ -0,0 +1,94 @@
+package secretun
+
+// A pipeline spreads the encoding or decoding of one connection over
+// several workers so sealing and compression scale across cores. Results
+// come out in the order the input went in, whichever worker took it, so
+// the handshake and every flow stay in order on the wire.
+type pipeline[I, O any] struct {
+	fn    func(I) (O, error)
+	in    []chan I
+	out   []chan pipelineResult[O]
+	order chan int
+	done  <-chan struct{}
+
+	// err is what next returns at the end, set before order is closed
+	err error
+}
+
+type pipelineResult[O any] struct {
+	v   O
+	err error
+}
+
+// newPipeline starts workers running fn. Workers and submit give up once
+// done is closed, a nil done keeps them going until close.
+func newPipeline[I, O any](workers int, fn func(I) (O, error), done <-chan struct{}) *pipeline[I, O] {
+	p := &pipeline[I, O]{
+		fn:    fn,
+		order: make(chan int, workers*packetQueueSize),
+		done:  done,
+	}
+	for i := 0; i < workers; i++ {
+		in := make(chan I, packetQueueSize)
+		out := make(chan pipelineResult[O], packetQueueSize)
+		p.in = append(p.in, in)
+		p.out = append(p.out, out)
+		go p.work(in, out)
+	}
+	return p
+}
+
+func (p *pipeline[I, O]) work(in chan I, out chan pipelineResult[O]) {
+	for v := range in {
+		o, err := p.fn(v)
+		select {
+		case out <- pipelineResult[O]{o, err}:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// submit hands v to the worker picked by key, it fails once done is closed
+func (p *pipeline[I, O]) submit(key uint32, v I) bool {
+	i := int(key % uint32(len(p.in)))
+	select {
+	case p.in[i] <- v:
+	case <-p.done:
+		return false
+	}
+	select {
+	case p.order <- i:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+// close ends the input, next returns err after the last result
+func (p *pipeline[I, O]) close(err error) {
+	p.err = err
+	close(p.order)
+	for _, in := range p.in {
+		close(in)
+	}
+}
+
+// next waits for the next result in order, ok is false at the end
+func (p *pipeline[I, O]) next() (v O, ok bool, err error) {
+	i, ok := <-p.order
+	if !ok {
+		return v, false, p.err
+	}
+	select {
+	case r := <-p.out[i]:
+		return r.v, true, r.err
+	case <-p.done:
+		return v, false, nil
+	}
+}
+
+// pending tells whether more results are on the way
+func (p *pipeline[I, O]) pending() bool {
+	return len(p.order) > 0
+}
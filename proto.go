@@ -4,20 +4,78 @@ import (
 	"net"
 )
 
+// Control messages, their wire:"N" tags are the field numbers of the wire
+// format and must never be reused, see marshalMessage
+
+// Hello is the first packet both ways, see clientHello. Version and
+// Message are only set by the server.
+type Hello struct {
+	MinVersion int      `wire:"1"`
+	MaxVersion int      `wire:"2"`
+	Features   []string `wire:"3"`
+	Version    int      `wire:"4"`
+	Message    string   `wire:"5"`
+	Nonce      []byte   `wire:"6"`
+}
+
+type KexInit struct {
+	Public []byte `wire:"1"`
+}
+
+type KexReply struct {
+	Public    []byte `wire:"1"`
+	Signature []byte `wire:"2"`
+}
+
+// EncoderOffer is one encoder the client can use
+type EncoderOffer struct {
+	Name   string            `wire:"1"`
+	Params map[string]string `wire:"2"`
+}
+
 type AuthInfo struct {
-	Username string
-	Password string
+	Username  string         `wire:"1"`
+	Password  string         `wire:"2"`
+	Encoders  []EncoderOffer `wire:"3"`
+	Mechanism string         `wire:"4"`
+	Nonce     string         `wire:"5"`
+	PublicKey []byte         `wire:"6"`
+
+	ResumeToken []byte `wire:"7"`
+}
+
+// AuthChallenge is sent in a PT_CHALLENGE during multi-step logins
+type AuthChallenge struct {
+	Nonce      string `wire:"1"`
+	Salt       []byte `wire:"2"`
+	Iterations int    `wire:"3"`
+}
+
+type AuthProof struct {
+	Proof []byte `wire:"1"`
 }
 
 type NatInfo struct {
-	IP      net.IP
-	Gateway net.IP
-	Netmask net.IPMask
-	MTU     int
+	IP      net.IP      `wire:"1"`
+	Gateway net.IP      `wire:"2"`
+	Netmask net.IPMask  `wire:"3"`
+	MTU     int         `wire:"4"`
+	Routes  []net.IPNet `wire:"5"`
+	DNS     []net.IP    `wire:"6"`
+
+	IP6      net.IP     `wire:"7"`
+	Gateway6 net.IP     `wire:"8"`
+	Netmask6 net.IPMask `wire:"9"`
+
+	RedirectGateway bool `wire:"10"`
 }
 
 type AuthResult struct {
-	Ok      bool
-	Message string
-	NatInfo NatInfo
+	Ok       bool     `wire:"1"`
+	Message  string   `wire:"2"`
+	NatInfo  NatInfo  `wire:"3"`
+	Encoders []string `wire:"4"`
+
+	ServerSignature []byte `wire:"5"`
+	ResumeToken     []byte `wire:"6"`
 }
@@ -0,0 +1,169 @@
+package secretun
+
+import (
+	"log"
+	"net"
+	"sync"
+	"syscall"
+)
+
+const routeQueueSize = 64
+
+type Router struct {
+	tun      *Tun
+	c2c      bool
+	lock     sync.RWMutex
+	sessions map[string]chan *Packet
+}
+
+func ipKey(ip net.IP) string {
+	return string(ip.To16())
+}
+
+func packetSrc(data []byte) net.IP {
+	switch {
+	case len(data) >= 20 && data[0]>>4 == 4:
+		return net.IP(data[12:16])
+	case len(data) >= 40 && data[0]>>4 == 6:
+		return net.IP(data[8:24])
+	}
+	return nil
+}
+
+func packetDst(data []byte) net.IP {
+	switch {
+	case len(data) >= 20 && data[0]>>4 == 4:
+		return net.IP(data[16:20])
+	case len(data) >= 40 && data[0]>>4 == 6:
+		return net.IP(data[24:40])
+	}
+	return nil
+}
+
+// flowHash maps the packets of one connection, by addresses, protocol
+// and ports, to the same number so they can be kept on one queue
+func flowHash(data []byte) uint32 {
+	var src, dst, ports []byte
+	var proto byte
+	switch {
+	case len(data) >= 20 && data[0]>>4 == 4:
+		src, dst, proto = data[12:16], data[16:20], data[9]
+		// ports are only in the first fragment
+		if ihl := int(data[0]&0x0f) * 4; data[6]&0x1f == 0 && data[7] == 0 && len(data) >= ihl+4 {
+			ports = data[ihl : ihl+4]
+		}
+	case len(data) >= 40 && data[0]>>4 == 6:
+		src, dst, proto = data[8:24], data[24:40], data[6]
+		if len(data) >= 44 {
+			ports = data[40:44]
+		}
+	default:
+		return 0
+	}
+	if proto != syscall.IPPROTO_TCP && proto != syscall.IPPROTO_UDP {
+		ports = nil
+	}
+
+	// FNV-1a
+	h := uint32(2166136261)
+	for _, part := range [][]byte{src, dst, {proto}, ports} {
+		for _, b := range part {
+			h ^= uint32(b)
+			h *= 16777619
+		}
+	}
+	return h
+}
+
+func NewRouter(tun *Tun, c2c bool) *Router {
+	r := new(Router)
+	r.tun = tun
+	r.c2c = c2c
+	r.sessions = map[string]chan *Packet{}
+	return r
+}
+
+func (r *Router) Add(ips ...net.IP) chan *Packet {
+	ch := make(chan *Packet, routeQueueSize)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, ip := range ips {
+		if ip != nil {
+			r.sessions[ipKey(ip)] = ch
+		}
+	}
+	return ch
+}
+
+func (r *Router) Remove(ips ...net.IP) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, ip := range ips {
+		if ip != nil {
+			delete(r.sessions, ipKey(ip))
+		}
+	}
+}
+
+func (r *Router) lookup(ip net.IP) chan *Packet {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.sessions[ipKey(ip)]
+}
+
+// deliver hands p to the session of dst, it keeps p unless it returns false
+func (r *Router) deliver(dst net.IP, p *Packet) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	ch, ok := r.sessions[ipKey(dst)]
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- p:
+	default:
+		// the session is not keeping up, drop like a full queue would
+		p.Release()
+	}
+	return true
+}
+
+// Forward sends p to the tun or, between clients, straight to the session
+// it is for. It drops packets whose source address is not routed to own.
+// Either way p is released or passed on.
+func (r *Router) Forward(own chan *Packet, p *Packet) error {
+	src := packetSrc(p.Data)
+	if src == nil || r.lookup(src) != own {
+		p.Release()
+		return nil
+	}
+
+	if r.c2c {
+		if dst := packetDst(p.Data); dst != nil && r.deliver(dst, p) {
+			return nil
+		}
+	}
+	return r.tun.Send(p)
+}
+
+func (r *Router) Run() error {
+	tun_ch, err := r.tun.ReadChan()
+	if err != nil {
+		return err
+	}
+
+	for p := range tun_ch {
+		if dst := packetDst(p.Data); dst == nil || !r.deliver(dst, p) {
+			p.Release()
+		}
+	}
+	log.Println("router: tun closed")
+	return nil
+}
+
+// Close closes the tun, which ends Run
+func (r *Router) Close() error {
+	return r.tun.Close()
+}
@@ -0,0 +1,239 @@
+package secretun
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// SCRAM-SHA-256 (RFC 5802, RFC 7677) without channel binding. The client
+// names the user and a nonce in AuthInfo, the server answers with an
+// AuthChallenge in a PT_CHALLENGE, the client proves the password in an
+// AuthProof and the server proves it holds the verifier with
+// AuthResult.ServerSignature. The password itself never crosses the wire.
+
+const (
+	scramMechanism = "scram-sha-256"
+	scramPrefix    = "$scram-sha-256$"
+	scramNonceSize = 18
+
+	// plaintext users file entries have nothing to protect at rest
+	scramPlainIter = 4096
+	// keeps a hostile server from making the client spin
+	scramMaxIter = 10000000
+)
+
+type scramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// scramSource is implemented by backends that can hand out SCRAM
+// verifiers, the file backend does
+type scramSource interface {
+	ScramCredentials(username string) (*User, *scramCredentials, error)
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+func scramSaltedPassword(password string, salt []byte, iter int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, iter, sha256.Size)
+}
+
+func newScramCredentials(salted, salt []byte, iter int) *scramCredentials {
+	stored := sha256.Sum256(scramHMAC(salted, "Client Key"))
+	return &scramCredentials{salt, iter, stored[:], scramHMAC(salted, "Server Key")}
+}
+
+// String is the users file form of the verifier:
+//
+//	$scram-sha-256$ITERATIONS$SALT$STOREDKEY$SERVERKEY
+func (c *scramCredentials) String() string {
+	b64 := base64.RawStdEncoding.EncodeToString
+	return fmt.Sprintf("%s%d$%s$%s$%s", scramPrefix, c.Iterations,
+		b64(c.Salt), b64(c.StoredKey), b64(c.ServerKey))
+}
+
+func parseScramCredentials(stored string) (*scramCredentials, error) {
+	segs := strings.Split(strings.TrimPrefix(stored, scramPrefix), "$")
+	if len(segs) != 4 {
+		return nil, fmt.Errorf("invalid scram hash")
+	}
+
+	c := &scramCredentials{}
+	var err error
+	if c.Iterations, err = strconv.Atoi(segs[0]); err != nil || c.Iterations <= 0 {
+		return nil, fmt.Errorf("invalid scram iterations")
+	}
+	for i, dest := range []*[]byte{&c.Salt, &c.StoredKey, &c.ServerKey} {
+		if *dest, err = base64.RawStdEncoding.DecodeString(segs[i+1]); err != nil {
+			return nil, fmt.Errorf("invalid scram hash")
+		}
+	}
+	return c, nil
+}
+
+// checkPassword for the verifier, used when a client sends the password
+func (c *scramCredentials) checkPassword(password string) (bool, error) {
+	salted, err := scramSaltedPassword(password, c.Salt, c.Iterations)
+	if err != nil {
+		return false, err
+	}
+	stored := sha256.Sum256(scramHMAC(salted, "Client Key"))
+	return subtle.ConstantTimeCompare(stored[:], c.StoredKey) == 1, nil
+}
+
+func scramNonce() (string, error) {
+	nonce := make([]byte, scramNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(nonce), nil
+}
+
+// scramAuthMessage is what both proofs sign, laid out as in RFC 5802
+func scramAuthMessage(username, client_nonce string, ch *AuthChallenge) string {
+	name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(username)
+	return "n=" + name + ",r=" + client_nonce + "," +
+		"r=" + ch.Nonce + ",s=" + base64.StdEncoding.EncodeToString(ch.Salt) +
+		",i=" + strconv.Itoa(ch.Iterations) + "," +
+		"c=biws,r=" + ch.Nonce
+}
+
+func scramXor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// verify checks a client proof and returns the server signature
+func (c *scramCredentials) verify(msg string, proof []byte) ([]byte, bool) {
+	signature := scramHMAC(c.StoredKey, msg)
+	if len(proof) != len(signature) {
+		return nil, false
+	}
+	client_key := scramXor(proof, signature)
+	stored := sha256.Sum256(client_key)
+	if subtle.ConstantTimeCompare(stored[:], c.StoredKey) != 1 {
+		return nil, false
+	}
+	return scramHMAC(c.ServerKey, msg), true
+}
+
+// scramFake makes up stable credentials for unknown users so the
+// challenge does not tell them apart from real ones
+func scramFake(username string) *scramCredentials {
+	salt := scramHMAC(scramFakeKey, username)[:pbkdf2Salt]
+	return &scramCredentials{salt, pbkdf2Iter, make([]byte, sha256.Size), make([]byte, sha256.Size)}
+}
+
+var scramFakeKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// clientScram is the client half, it returns the final AuthResult after
+// checking the server signature
+func clientScram(cli_ch *ClientChan, info AuthInfo, password string) (*AuthResult, error) {
+	var err error
+	var ch AuthChallenge
+
+	info.Mechanism = scramMechanism
+	if info.Nonce, err = scramNonce(); err != nil {
+		return nil, err
+	}
+	cli_ch.W <- NewPacket(PT_AUTH, &info)
+
+	if rst, err := recvChallenge(cli_ch, &ch); rst != nil || err != nil {
+		return rst, err
+	}
+	if !strings.HasPrefix(ch.Nonce, info.Nonce) || len(ch.Nonce) == len(info.Nonce) {
+		return nil, fmt.Errorf("auth challenge does not extend our nonce")
+	} else if ch.Iterations <= 0 || ch.Iterations > scramMaxIter {
+		return nil, fmt.Errorf("auth challenge asks for %d iterations", ch.Iterations)
+	}
+
+	salted, err := scramSaltedPassword(password, ch.Salt, ch.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	msg := scramAuthMessage(info.Username, info.Nonce, &ch)
+	client_key := scramHMAC(salted, "Client Key")
+	stored := sha256.Sum256(client_key)
+	proof := scramXor(client_key, scramHMAC(stored[:], msg))
+	cli_ch.W <- NewPacket(PT_AUTH, &AuthProof{proof})
+
+	rst, err := recvAuthResult(cli_ch)
+	if err != nil {
+		return nil, err
+	}
+	if rst.Ok {
+		want := scramHMAC(scramHMAC(salted, "Server Key"), msg)
+		if !hmac.Equal(want, rst.ServerSignature) {
+			return nil, fmt.Errorf("server failed to prove it knows the password")
+		}
+	}
+	return rst, nil
+}
+
+// scramChallenge is the server half up to the proof, it returns the user,
+// or nil if the proof is wrong, and the server signature
+func (c *serverConfig) scramChallenge(cli_ch *ClientChan, name string, info *AuthInfo) (*User, []byte, error) {
+	source, ok := c.authenticator.(scramSource)
+	if c.authenticator == nil {
+		return nil, nil, fmt.Errorf("password login not configured")
+	} else if !ok {
+		return nil, nil, fmt.Errorf("auth backend does not support %s", scramMechanism)
+	}
+	if len(info.Nonce) == 0 {
+		return nil, nil, fmt.Errorf("scram: missing client nonce")
+	}
+
+	user, creds, err := source.ScramCredentials(name)
+	if err != nil {
+		log.Printf("user %s: %v", name, err)
+		creds = scramFake(name)
+	}
+
+	server_nonce, err := scramNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	ch := AuthChallenge{info.Nonce + server_nonce, creds.Salt, creds.Iterations}
+	cli_ch.W <- NewPacket(PT_CHALLENGE, &ch)
+
+	var proof AuthProof
+	p, err := cli_ch.Recv()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.Type != PT_AUTH {
+		return nil, nil, fmt.Errorf("scram: expected the proof, got packet type %d", p.Type)
+	}
+	if p.Decode(&proof) != nil {
+		return nil, nil, fmt.Errorf("scram: invalid proof")
+	}
+
+	signature, ok := creds.verify(scramAuthMessage(name, info.Nonce, &ch), proof.Proof)
+	if !ok || user == nil {
+		log.Printf("user %s: wrong scram proof", name)
+		return nil, nil, nil
+	}
+	return user, signature, nil
+}
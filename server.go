@@ -1,53 +1,178 @@
 package secretun
 
 import (
-	"bufio"
+	"crypto/ed25519"
 	"fmt"
-	"io"
 	"log"
-	"os"
-	"strings"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// shutdownTimeout bounds how long Shutdown waits for clients to hang up
+const shutdownTimeout = 5 * time.Second
+
+// serverLoginTimeout bounds how long a client may take from connecting to
+// its AuthResult, so idle connections and junk udp sessions don't pile up.
+// It leaves the client's own loginTimeout room to give up first.
+const serverLoginTimeout = 30 * time.Second
+
+// userConfig needs at least one of Users, Backend and Authorized_keys,
+// newAuthenticator checks which
 type userConfig struct {
-	Users string
+	Users           string `config:"optional"`
+	Backend         Config `config:"optional"`
+	Cert_login      bool   `config:"optional"`
+	Key_file        string `config:"optional"`
+	Require_kex     bool   `config:"optional"`
+	Require_scram   bool   `config:"optional"`
+	Authorized_keys string `config:"optional"`
 }
 
 type natConfig struct {
-	Net     string
-	Gateway string
-	Mtu     int
+	Net              string
+	Gateway          string
+	Net6             string `config:"optional"`
+	Gateway6         string `config:"optional"`
+	Mtu              int
+	Shared           bool     `config:"optional"`
+	Client_to_client bool     `config:"optional"`
+	Lease_grace      int      `config:"optional"`
+	Resume_timeout   int      `config:"optional"`
+	Routes           []string `config:"optional"`
+	Dns              []string `config:"optional"`
+	Redirect_gateway bool     `config:"optional"`
+	Queues           int      `config:"optional"`
 }
 
 type Server struct {
 	cfg        Config
-	user_cfg   userConfig
 	nat_cfg    natConfig
 	tunnel_cfg Config
+	live       *atomic.Pointer[serverConfig]
+	// reload_lock keeps two reloads from interleaving their updates
+	reload_lock *sync.Mutex
 
-	tunnel ServerTunnel
-	ippool IPPool
+	tunnel   ServerTunnel
+	ippool   *IPPool
+	ippool6  *IPPool
+	router   *Router
+	sessions *sessionTable
+	clients  *clientGroup
+	stopped  chan struct{}
+}
+
+// serverConfig is the part of the configuration Reload can change. It is
+// swapped as a whole, nat_cfg only counts for what is pushed to clients,
+// the server keeps the addresses and tun it started with.
+type serverConfig struct {
+	user_cfg      userConfig
+	nat_cfg       natConfig
+	packet        *packetConfig
+	keepalive     keepaliveConfig
+	authenticator Authenticator
+	kex_key       ed25519.PrivateKey
+	authorized    *authorizedKeys
+	routes        []net.IPNet
+	dns           []net.IP
+}
+
+// clientGroup tracks the clients being served so Shutdown can wait for
+// them, quit is closed once the server shuts down
+type clientGroup struct {
+	lock    sync.Mutex
+	wg      sync.WaitGroup
+	closing bool
+	quit    chan struct{}
+}
+
+func newClientGroup() *clientGroup {
+	return &clientGroup{quit: make(chan struct{})}
+}
+
+// add counts a new client, it fails once the server shuts down
+func (g *clientGroup) add() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.closing {
+		return false
+	}
+	g.wg.Add(1)
+	return true
+}
+
+func (g *clientGroup) done() {
+	g.wg.Done()
+}
+
+// close turns new clients away and tells the others to hang up, it returns
+// false if it was closed before
+func (g *clientGroup) close() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.closing {
+		return false
+	}
+	g.closing = true
+	close(g.quit)
+	return true
+}
+
+func (g *clientGroup) closed() bool {
+	select {
+	case <-g.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait returns false if clients are still there after timeout
+func (g *clientGroup) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
 
 func NewServer(cfg Config) (ser Server, err error) {
 	ser.cfg = cfg
-	if pkg_cfg, e := cfg.GetConfig("packet"); e != nil {
-		err = e
-		return
-	} else if err = InitPacket(pkg_cfg); err != nil {
-		return
-	}
+	ser.clients = newClientGroup()
+	ser.stopped = make(chan struct{})
+	ser.live = new(atomic.Pointer[serverConfig])
+	ser.reload_lock = new(sync.Mutex)
 
-	if err = cfg.Get("auth", &ser.user_cfg); err != nil {
+	conf, err := loadServerConfig(cfg)
+	if err != nil {
 		return
 	}
+	ser.live.Store(conf)
+	ser.nat_cfg = conf.nat_cfg
 
-	if err = cfg.Get("nat", &ser.nat_cfg); err != nil {
+	ser.sessions = newSessionTable(conf.resumeTimeout(), conf.keepalive, ser.releaseIP)
+	if ser.ippool, err = NewIPPool(ser.nat_cfg.Net, ser.nat_cfg.Gateway); err != nil {
 		return
 	}
-	if ser.ippool, err = NewIPPool(ser.nat_cfg.Net, ser.nat_cfg.Gateway); err != nil {
+	ser.ippool.Grace = conf.leaseGrace()
+	if len(ser.nat_cfg.Net6) > 0 {
+		if ser.ippool6, err = NewIPPool(ser.nat_cfg.Net6, ser.nat_cfg.Gateway6); err != nil {
+			return
+		}
+		ser.ippool6.Grace = ser.ippool.Grace
+	}
+	if err = ser.pinUsers(conf); err != nil {
 		return
 	}
+	ser.watchUsers(conf, nil)
 
 	var tunnel_name string
 	if ser.tunnel_cfg, err = cfg.GetConfig("tunnel"); err != nil {
@@ -56,80 +181,538 @@ func NewServer(cfg Config) (ser Server, err error) {
 		return
 	}
 
-	ser.tunnel, err = NewServerTunnel(tunnel_name)
+	if ser.tunnel, err = NewServerTunnel(tunnel_name); err != nil {
+		return
+	}
+	err = conf.packet.checkTunnel(ser.tunnel)
 
 	return
 }
 
+// loadServerConfig reads everything but the tunnel and the address pools
+func loadServerConfig(cfg Config) (conf *serverConfig, err error) {
+	conf = &serverConfig{}
+	if pkg_cfg, e := cfg.GetConfig("packet"); e != nil {
+		return nil, e
+	} else if conf.packet, err = newPacketConfig(pkg_cfg); err != nil {
+		return nil, err
+	}
+
+	if err = cfg.Get("auth", &conf.user_cfg); err != nil {
+		return nil, err
+	}
+	if conf.authenticator, err = newAuthenticator(conf.user_cfg); err != nil {
+		return nil, err
+	}
+	if len(conf.user_cfg.Authorized_keys) > 0 {
+		if conf.authorized, err = newAuthorizedKeys(conf.user_cfg.Authorized_keys); err != nil {
+			return nil, err
+		}
+	}
+	if len(conf.user_cfg.Key_file) > 0 {
+		if conf.kex_key, err = loadPrivateKey(conf.user_cfg.Key_file); err != nil {
+			return nil, err
+		}
+	} else if conf.user_cfg.Require_kex {
+		return nil, fmt.Errorf("auth: require_kex needs key_file")
+	}
+
+	conf.nat_cfg.Resume_timeout = defaultResumeTimeout
+	conf.nat_cfg.Queues = 1
+	if err = cfg.Get("nat", &conf.nat_cfg); err != nil {
+		return nil, err
+	} else if conf.nat_cfg.Queues < 1 {
+		return nil, fmt.Errorf("nat: queues must be at least 1")
+	}
+	if conf.keepalive, err = newKeepaliveConfig(cfg); err != nil {
+		return nil, err
+	}
+	for _, r := range conf.nat_cfg.Routes {
+		_, ipnet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, err
+		}
+		conf.routes = append(conf.routes, *ipnet)
+	}
+	for _, d := range conf.nat_cfg.Dns {
+		ip := net.ParseIP(d)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid dns server: %s", d)
+		}
+		conf.dns = append(conf.dns, ip)
+	}
+	return conf, nil
+}
+
+func (c *serverConfig) resumeTimeout() time.Duration {
+	return time.Duration(c.nat_cfg.Resume_timeout) * time.Second
+}
+
+func (c *serverConfig) leaseGrace() time.Duration {
+	return time.Duration(c.nat_cfg.Lease_grace) * time.Second
+}
+
+// conf is the configuration for new logins, take it once and keep it
+func (s *Server) conf() *serverConfig {
+	return s.live.Load()
+}
+
+// newAuthenticator sets up auth.backend, a plain auth.users is short for
+// the file backend
+func newAuthenticator(user_cfg userConfig) (a Authenticator, err error) {
+	backend := user_cfg.Backend
+	if backend.Map == nil {
+		if len(user_cfg.Users) == 0 && len(user_cfg.Authorized_keys) > 0 {
+			// key login only
+			return nil, nil
+		} else if len(user_cfg.Users) == 0 {
+			return nil, fmt.Errorf("auth: users, backend or authorized_keys is required")
+		}
+		backend.Map = map[string]interface{}{"name": "file", "path": user_cfg.Users}
+	}
+	backend.Name = ".auth.backend"
+
+	var name string
+	if err = backend.Get("name", &name); err != nil {
+		return
+	} else if a, err = NewAuthenticator(name); err != nil {
+		return
+	}
+	return a, a.Init(backend)
+}
+
+// pinUsers reserves the fixed addresses of conf's users, see pin
+func (s *Server) pinUsers(conf *serverConfig) error {
+	var users []*User
+	if lister, ok := conf.authenticator.(userLister); ok {
+		users = lister.Users()
+	}
+	return s.pin(users)
+}
+
+// watchUsers keeps the pins up to date when the backend of conf reloads
+// its users, and stops the one of old doing so
+func (s *Server) watchUsers(conf, old *serverConfig) {
+	if old != nil {
+		if w, ok := old.authenticator.(userWatcher); ok {
+			w.watchUsers(nil)
+		}
+	}
+	if w, ok := conf.authenticator.(userWatcher); ok {
+		w.watchUsers(s.pin)
+	}
+}
+
+// pin reserves the fixed addresses of users, replacing the ones pinned
+// before. Nothing changes if one of them is invalid.
+func (s *Server) pin(users []*User) error {
+	pins, pins6 := map[string]net.IP{}, map[string]net.IP{}
+	for _, u := range users {
+		if u.IP != nil {
+			pins[u.Name] = u.IP
+		}
+		if u.IP6 != nil {
+			if s.ippool6 == nil {
+				return fmt.Errorf("user %s: ip6 set but nat.net6 is not configured", u.Name)
+			}
+			pins6[u.Name] = u.IP6
+		}
+	}
+
+	pinned, err := s.ippool.pinIndexes(pins)
+	if err != nil {
+		return err
+	}
+	if s.ippool6 != nil {
+		pinned6, err := s.ippool6.pinIndexes(pins6)
+		if err != nil {
+			return err
+		}
+		s.ippool6.setPinned(pinned6)
+	}
+	s.ippool.setPinned(pinned)
+	return nil
+}
+
 func (s *Server) Init() error {
+	if s.nat_cfg.Shared {
+		if err := s.initRouter(); err != nil {
+			return err
+		}
+	}
 	return s.tunnel.Init(s.tunnel_cfg)
 }
 
+func (s *Server) initRouter() error {
+	tun, err := CreateTunQueues("", s.nat_cfg.Queues)
+	if err != nil {
+		return err
+	}
+
+	if err := tun.SetSelfAddr(s.ippool.Gateway); err != nil {
+		tun.Close()
+		return err
+	}
+	if err := tun.SetNetmask(s.ippool.IPNet.Mask); err != nil {
+		tun.Close()
+		return err
+	}
+	if s.ippool6 != nil {
+		ones, _ := s.ippool6.IPNet.Mask.Size()
+		if err := tun.SetAddr6(s.ippool6.Gateway, ones); err != nil {
+			tun.Close()
+			return err
+		}
+	}
+	if s.nat_cfg.Mtu > 0 {
+		if err := tun.SetMTU(s.nat_cfg.Mtu); err != nil {
+			tun.Close()
+			return err
+		}
+	}
+	if err := tun.Up(); err != nil {
+		tun.Close()
+		return err
+	}
+
+	log.Println("shared tun:", tun.Name)
+	s.router = NewRouter(tun, s.nat_cfg.Client_to_client)
+	go func() {
+		if err := s.router.Run(); err != nil {
+			log.Println(err)
+		}
+	}()
+	return nil
+}
+
 func (s *Server) Run() error {
 	for {
-		if cli_ch, err := s.tunnel.Accept(); err != nil {
+		cli_ch, err := s.tunnel.Accept()
+		if err != nil {
+			if s.clients.closed() {
+				<-s.stopped
+				return nil
+			}
 			return err
-		} else {
-			go s.handle_client(cli_ch)
 		}
+		if !s.clients.add() {
+			cli_ch.Close()
+			continue
+		}
+		go func() {
+			defer s.clients.done()
+			s.handle_client(cli_ch)
+		}()
 	}
-	return nil
 }
 
+// Shutdown sends PT_SHUTDOWN to every client, gives them shutdownTimeout to
+// hang up and closes the listener and the shared tun. Run returns once it
+// is done.
 func (s *Server) Shutdown() error {
-	return nil
+	if !s.clients.close() {
+		return fmt.Errorf("already shutting down")
+	}
+	defer close(s.stopped)
+
+	var err error
+	if !s.clients.wait(shutdownTimeout) {
+		err = fmt.Errorf("clients still connected after %v", shutdownTimeout)
+	}
+	if e := s.tunnel.Shutdown(); e != nil && err == nil {
+		err = e
+	}
+	if s.router != nil {
+		s.router.Close()
+	}
+	return err
+}
+
+// Reload applies cfg to new logins: users and auth backend, encoders,
+// pushed nat options, keepalive and timeouts. Connected clients keep what
+// they got. It returns the settings that need a restart to change.
+func (s *Server) Reload(cfg Config) (restart []string, err error) {
+	s.reload_lock.Lock()
+	defer s.reload_lock.Unlock()
+
+	conf, err := loadServerConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err = conf.packet.checkTunnel(s.tunnel); err != nil {
+		return nil, err
+	}
+	if err = s.pinUsers(conf); err != nil {
+		return nil, err
+	}
+
+	old := s.live.Swap(conf)
+	s.watchUsers(conf, old)
+	s.sessions.configure(conf.resumeTimeout(), conf.keepalive)
+	s.ippool.SetGrace(conf.leaseGrace())
+	if s.ippool6 != nil {
+		s.ippool6.SetGrace(conf.leaseGrace())
+	}
+	if mtu := conf.nat_cfg.Mtu; s.router != nil && mtu > 0 && mtu != old.nat_cfg.Mtu {
+		if err := s.router.tun.SetMTU(mtu); err != nil {
+			log.Println("shared tun:", err)
+		}
+	}
+
+	tunnel_cfg, _ := cfg.GetConfig("tunnel")
+	nat_cfg := conf.nat_cfg
+	for _, c := range []struct {
+		name     string
+		was, now interface{}
+	}{
+		{"tunnel", s.tunnel_cfg.Map, tunnel_cfg.Map},
+		{"nat.net", s.nat_cfg.Net, nat_cfg.Net},
+		{"nat.gateway", s.nat_cfg.Gateway, nat_cfg.Gateway},
+		{"nat.net6", s.nat_cfg.Net6, nat_cfg.Net6},
+		{"nat.gateway6", s.nat_cfg.Gateway6, nat_cfg.Gateway6},
+		{"nat.shared", s.nat_cfg.Shared, nat_cfg.Shared},
+		{"nat.client_to_client", s.nat_cfg.Client_to_client, nat_cfg.Client_to_client},
+	} {
+		if !reflect.DeepEqual(c.was, c.now) {
+			restart = append(restart, c.name)
+		}
+	}
+	// a tun per client gets the new queues when the client connects
+	if s.router != nil && nat_cfg.Queues != s.nat_cfg.Queues {
+		restart = append(restart, "nat.queues")
+	}
+	return restart, nil
+}
+
+// Sessions lists the logged in clients, including those waiting to resume
+func (s *Server) Sessions() []SessionStatus {
+	return s.sessions.status()
 }
 
 func (s *Server) handle_client(cli_ch ClientChan) {
-	defer cli_ch.Close()
+	defer cli_ch.CloseWait(flushTimeout)
 
-	nat_info, err := s.auth(&cli_ch)
+	packet := s.conf().packet
+	seal, err := packet.seal()
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	if err = s.nat(&cli_ch, nat_info); err != nil {
+	cli_ch.codec.start(seal, packet.workers)
+
+	timer := time.AfterFunc(serverLoginTimeout, func() {
+		cli_ch.fail(fmt.Errorf("no login within %v", serverLoginTimeout))
+	})
+	sess, conn, err := s.auth(&cli_ch)
+	timer.Stop()
+	if err != nil {
 		log.Println(err)
+		return
+	}
+
+	switch err = s.nat(&cli_ch, sess.nat_info, conn); err {
+	case errShutdown, errPeerShutdown:
+		// no resume after a goodbye
+		log.Printf("user %s: %v", sess.user.Name, err)
+		s.sessions.end(sess, conn)
+	default:
+		if err != nil {
+			log.Println(err)
+		}
+		s.sessions.detach(sess, conn)
 	}
 }
 
-func (s *Server) auth(cli_ch *ClientChan) (nf NatInfo, err error) {
+func (s *Server) auth(cli_ch *ClientChan) (sess *session, conn *sessionConn, err error) {
 	var auth_info AuthInfo
 	var rst AuthResult
+	var user *User
+	conf := s.conf()
+
+	p, err := cli_ch.Recv()
+	if err != nil {
+		return
+	}
+	if p.Type == PT_HELLO {
+		if err = serverHello(cli_ch, p, conf.packet.keyed); err != nil {
+			return
+		}
+		if p, err = cli_ch.Recv(); err != nil {
+			return
+		}
+	} else if err = legacyHello(conf.packet.keyed); err != nil {
+		s.refuse(cli_ch, err)
+		return
+	}
+	if p.Type == PT_KEX {
+		if conf.kex_key == nil {
+			err = fmt.Errorf("key exchange not configured")
+			s.refuse(cli_ch, err)
+			return
+		}
+		if err = serverKex(cli_ch, p, conf.kex_key); err != nil {
+			return
+		}
+		if p, err = cli_ch.Recv(); err != nil {
+			return
+		}
+	} else if conf.user_cfg.Require_kex {
+		err = fmt.Errorf("key exchange required")
+		s.refuse(cli_ch, err)
+		return
+	}
 
-	p := <-cli_ch.R
 	if p.Decode(&auth_info) != nil {
 		err = fmt.Errorf("invalid auth info")
 		return
 	}
 
-	if !s.check_user(&auth_info) {
-		rst.Ok = false
+	if len(auth_info.ResumeToken) > 0 {
+		if sess, conn, err = s.sessions.resume(auth_info.ResumeToken, cli_ch.Identity); err != nil {
+			s.refuse(cli_ch, err)
+			return
+		}
+		user = sess.user
+		log.Printf("user %s resumed its session", user.Name)
+	} else if user, err = s.login(conf, cli_ch, &auth_info, &rst); err != nil {
+		s.refuse(cli_ch, err)
+		return
+	}
+
+	var names []string
+	var encoders Encoders
+	if user == nil {
+		rst.Message = "authentication failed"
 		err = fmt.Errorf("invalid user")
-	} else if s.ippool.IsEmpty() {
-		rst.Ok = false
-		rst.Message = "ip used up"
-		err = fmt.Errorf("ip used up")
-	} else {
+	} else if names, err = conf.packet.choose(auth_info.Encoders); err != nil {
+		rst.Message = err.Error()
+		err = fmt.Errorf("user %s: %v", user.Name, err)
+	} else if encoders, err = conf.packet.build(names); err == nil && sess == nil {
+		if sess, conn, err = s.open(conf, user); err != nil {
+			rst.Message = err.Error()
+		}
+	}
+	if err == nil {
+		// the reply goes out before the encoders, PT_AUTH never uses them
+		err = cli_ch.codec.setEncoders(encoders)
+	}
+	if err == nil {
 		rst.Ok = true
-		rst.NatInfo.Gateway = s.ippool.Gateway
-		rst.NatInfo.Netmask = s.ippool.IPNet.Mask
-		rst.NatInfo.IP = s.ippool.Next()
-		rst.NatInfo.MTU = s.nat_cfg.Mtu
-		nf = rst.NatInfo
+		rst.Encoders = names
+		rst.NatInfo = sess.nat_info
+		if cli_ch.codec.feature(featureResume) {
+			rst.ResumeToken = conn.token
+		}
 	}
 
 	if p.Encode(&rst) != nil {
 		err = fmt.Errorf("encode AuthResult fail")
+	} else {
+		cli_ch.W <- p
+	}
+	if err != nil && sess != nil {
+		s.sessions.detach(sess, conn)
+		return nil, nil, err
+	}
+	return
+}
+
+// login checks the credentials in info, the user is nil if they are wrong
+func (s *Server) login(conf *serverConfig, cli_ch *ClientChan, info *AuthInfo, rst *AuthResult) (user *User, err error) {
+	switch info.Mechanism {
+	case "":
+		if conf.user_cfg.Require_scram && !conf.certLogin(cli_ch.Identity) {
+			return nil, fmt.Errorf("password login disabled, use %s", scramMechanism)
+		}
+		return conf.check_user(info, cli_ch.Identity), nil
+	case keyMechanism:
+		return conf.keyChallenge(cli_ch, info)
+	case scramMechanism:
+		if name, ok := userName(info, cli_ch.Identity); ok {
+			user, rst.ServerSignature, err = conf.scramChallenge(cli_ch, name, info)
+		}
 		return
 	}
-	cli_ch.W <- p
+	return nil, fmt.Errorf("unsupported auth mechanism %q", info.Mechanism)
+}
+
+// open starts a new session for user with fresh addresses
+func (s *Server) open(conf *serverConfig, user *User) (*session, *sessionConn, error) {
+	ip, ip6, err := s.allocIP(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var nf NatInfo
+	nf.Gateway = s.ippool.Gateway
+	nf.Netmask = s.ippool.IPNet.Mask
+	nf.IP = ip
+	if ip6 != nil {
+		nf.IP6 = ip6
+		nf.Gateway6 = s.ippool6.Gateway
+		nf.Netmask6 = s.ippool6.IPNet.Mask
+	}
+	nf.MTU = conf.nat_cfg.Mtu
+	if user.MTU > 0 {
+		nf.MTU = user.MTU
+	}
+	nf.Routes = append(append([]net.IPNet{}, conf.routes...), user.Routes...)
+	nf.DNS = conf.dns
+	nf.RedirectGateway = conf.nat_cfg.Redirect_gateway
+
+	sess, conn, err := s.sessions.open(user, nf)
+	if err != nil {
+		s.releaseIP(nf)
+	}
+	return sess, conn, err
+}
+
+func (s *Server) refuse(cli_ch *ClientChan, reason error) {
+	cli_ch.W <- NewPacket(PT_AUTH, &AuthResult{Ok: false, Message: reason.Error()})
+}
 
+func allocFrom(pool *IPPool, user string, pinned net.IP) (net.IP, error) {
+	if pinned != nil {
+		if err := pool.Take(pinned, user); err != nil {
+			return nil, err
+		}
+		return pinned, nil
+	}
+
+	if ip := pool.Next(user); ip != nil {
+		return ip, nil
+	}
+	return nil, fmt.Errorf("ip used up")
+}
+
+func (s *Server) allocIP(user *User) (ip, ip6 net.IP, err error) {
+	if ip, err = allocFrom(s.ippool, user.Name, user.IP); err != nil {
+		return
+	}
+	if s.ippool6 != nil {
+		if ip6, err = allocFrom(s.ippool6, user.Name, user.IP6); err != nil {
+			s.ippool.Release(ip)
+			return nil, nil, err
+		}
+	}
 	return
 }
 
-func (s *Server) nat(cli_ch *ClientChan, nat_info NatInfo) error {
-	tun, err := CreateTun("")
+func (s *Server) releaseIP(nat_info NatInfo) {
+	s.ippool.Release(nat_info.IP)
+	if s.ippool6 != nil {
+		s.ippool6.Release(nat_info.IP6)
+	}
+}
+
+// nat forwards between the client and a tun until the connection ends,
+// goes silent or is kicked by a connection that resumed the session
+func (s *Server) nat(cli_ch *ClientChan, nat_info NatInfo, conn *sessionConn) error {
+	if s.router != nil {
+		return s.route(cli_ch, nat_info, conn)
+	}
+
+	tun, err := CreateTunQueues("", s.conf().nat_cfg.Queues)
 
 	if err != nil {
 		return err
@@ -142,8 +725,13 @@ func (s *Server) nat(cli_ch *ClientChan, nat_info NatInfo) error {
 	if err := tun.SetNetmask(nat_info.Netmask); err != nil {
 		return err
 	}
-	if s.nat_cfg.Mtu > 0 {
-		if err := tun.SetMTU(s.nat_cfg.Mtu); err != nil {
+	if nat_info.IP6 != nil {
+		if err := tun.SetAddr6(nat_info.Gateway6, 128); err != nil {
+			return err
+		}
+	}
+	if nat_info.MTU > 0 {
+		if err := tun.SetMTU(nat_info.MTU); err != nil {
 			return err
 		}
 	}
@@ -155,6 +743,12 @@ func (s *Server) nat(cli_ch *ClientChan, nat_info NatInfo) error {
 	if err := tun.Up(); err != nil {
 		return err
 	}
+	if nat_info.IP6 != nil {
+		host := net.IPNet{IP: nat_info.IP6, Mask: net.CIDRMask(128, 128)}
+		if err := tun.AddRoute(host); err != nil {
+			return err
+		}
+	}
 
 	for {
 		select {
@@ -163,55 +757,148 @@ func (s *Server) nat(cli_ch *ClientChan, nat_info NatInfo) error {
 				log.Println("tunnel closed")
 				return nil
 			}
+			conn.alive.seen()
 			if packet.Type == PT_P2P {
-				if _, err := tun.Write(packet.Data); err != nil {
+				if err := tun.Send(packet); err != nil {
 					return nil
 				}
-			} else {
+			} else if packet.Type == PT_SHUTDOWN {
+				return errPeerShutdown
+			} else if !conn.alive.handle(cli_ch, packet) {
 				return nil
 			}
-		case data, ok := <-tun_ch:
+		case packet, ok := <-tun_ch:
 			if !ok {
 				log.Println("chan closed")
 				return nil
 			}
-			p := NewPacket(PT_P2P, data)
-			cli_ch.W <- p
+			if err := push(cli_ch, conn, packet); err != nil {
+				return err
+			}
 		case err := <-cli_ch.End:
 			return err
+		case <-conn.alive.C:
+			if err := conn.alive.tick(cli_ch); err != nil {
+				return err
+			}
+		case <-conn.kick:
+			return errSessionResumed
+		case <-s.clients.quit:
+			push(cli_ch, conn, NewPacket(PT_SHUTDOWN, []byte{}))
+			return errShutdown
 		}
 	}
 
 	return nil
 }
 
-func (s *Server) check_user(info *AuthInfo) bool {
-	f, err := os.Open(s.user_cfg.Users)
-	if err != nil {
-		return false
-	}
-	defer f.Close()
+func (s *Server) route(cli_ch *ClientChan, nat_info NatInfo, conn *sessionConn) error {
+	tun_ch := s.router.Add(nat_info.IP, nat_info.IP6)
+	defer s.router.Remove(nat_info.IP, nat_info.IP6)
 
-	buf := bufio.NewReader(f)
 	for {
-		line, err := buf.ReadString('\n')
-		if err != nil && err != io.EOF {
-			break
-		}
-		if len(line) == 0 || line[0] == '#' {
-			continue
+		select {
+		case packet, ok := <-cli_ch.R:
+			if !ok {
+				log.Println("tunnel closed")
+				return nil
+			}
+			conn.alive.seen()
+			if packet.Type == PT_P2P {
+				if err := s.router.Forward(tun_ch, packet); err != nil {
+					log.Println("write tun:", err)
+				}
+			} else if packet.Type == PT_SHUTDOWN {
+				return errPeerShutdown
+			} else if !conn.alive.handle(cli_ch, packet) {
+				return nil
+			}
+		case packet := <-tun_ch:
+			if err := push(cli_ch, conn, packet); err != nil {
+				return err
+			}
+		case err := <-cli_ch.End:
+			return err
+		case <-conn.alive.C:
+			if err := conn.alive.tick(cli_ch); err != nil {
+				return err
+			}
+		case <-conn.kick:
+			return errSessionResumed
+		case <-s.clients.quit:
+			push(cli_ch, conn, NewPacket(PT_SHUTDOWN, []byte{}))
+			return errShutdown
 		}
+	}
+}
 
-		segs := strings.Split(line, " ")
-		if len(segs) != 2 {
-			continue
-		}
-		if segs[1][len(segs[1])-1] == '\n' {
-			segs[1] = segs[1][:len(segs[1])-1]
-		}
-		if string(segs[0]) == info.Username {
-			return string(segs[1]) == info.Password
+// push queues packet for the client. It gives up once the session is taken
+// over or the tunnel is gone, so a stalled writer can't hold up a resume.
+func push(cli_ch *ClientChan, conn *sessionConn, packet *Packet) error {
+	select {
+	case cli_ch.W <- packet:
+		return nil
+	case <-conn.kick:
+		packet.Release()
+		return errSessionResumed
+	case err := <-cli_ch.End:
+		packet.Release()
+		return err
+	case <-cli_ch.Done:
+		packet.Release()
+		return fmt.Errorf("tunnel closed")
+	}
+}
+
+// userName is the user a client logs in as, which has to match the name in
+// its certificate if it sent one
+func userName(info *AuthInfo, identity string) (string, bool) {
+	name := info.Username
+	if len(identity) > 0 {
+		if len(name) == 0 {
+			name = identity
+		} else if name != identity {
+			log.Printf("user %s presented certificate of %s", name, identity)
+			return "", false
 		}
 	}
-	return false
+	return name, true
+}
+
+func (c *serverConfig) certLogin(identity string) bool {
+	return len(identity) > 0 && c.user_cfg.Cert_login
+}
+
+// lookupUser finds the settings of a user that proved who it is without
+// a password
+func (c *serverConfig) lookupUser(name string) (*User, error) {
+	if lookup, ok := c.authenticator.(userLookup); ok {
+		return lookup.Lookup(name)
+	}
+	return &User{Name: name}, nil
+}
+
+// check_user authenticates the user behind info. identity is the name from
+// a verified client certificate: it must match the username, and with
+// cert_login it replaces the password.
+func (c *serverConfig) check_user(info *AuthInfo, identity string) *User {
+	name, ok := userName(info, identity)
+	if !ok {
+		return nil
+	}
+
+	var user *User
+	var err error
+	if c.certLogin(identity) {
+		user, err = c.lookupUser(name)
+	} else if c.authenticator == nil {
+		err = fmt.Errorf("password login not configured")
+	} else {
+		user, err = c.authenticator.Authenticate(name, info.Password)
+	}
+	if err != nil {
+		log.Printf("user %s: %v", name, err)
+		return nil
+	}
+	return user
 }
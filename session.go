@@ -0,0 +1,218 @@
+package secretun
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A session is a login that outlives its connection for resume_timeout.
+// AuthResult hands the client a token, a client that reconnects with it
+// in AuthInfo takes the session over, addresses included, without logging
+// in again. Every connection gets a fresh token.
+
+const (
+	sessionTokenSize     = 32
+	defaultResumeTimeout = 60
+
+	// resumeWait bounds how long a resume waits for the connection it
+	// takes over to let go of the addresses
+	resumeWait = 5 * time.Second
+)
+
+var errSessionResumed = fmt.Errorf("session resumed on another connection")
+
+type session struct {
+	user     *User
+	nat_info NatInfo
+
+	// guarded by sessionTable.lock
+	token string
+	conn  *sessionConn
+	timer *time.Timer
+	// kicked is done of the last connection taken over, which may still
+	// be letting go
+	kicked chan struct{}
+}
+
+// sessionConn is one connection attached to a session. kick is closed when
+// another connection takes the session over, done once this one let go.
+type sessionConn struct {
+	token []byte
+	alive *keepalive
+	kick  chan struct{}
+	done  chan struct{}
+}
+
+// SessionStatus describes a logged in client for monitoring
+type SessionStatus struct {
+	User      string
+	IP        net.IP
+	IP6       net.IP
+	Connected bool
+	RTT       time.Duration
+}
+
+type sessionTable struct {
+	release func(NatInfo)
+
+	lock      sync.Mutex
+	timeout   time.Duration
+	keepalive keepaliveConfig
+	sessions  map[string]*session
+}
+
+func newSessionTable(timeout time.Duration, kc keepaliveConfig, release func(NatInfo)) *sessionTable {
+	return &sessionTable{
+		timeout:   timeout,
+		keepalive: kc,
+		release:   release,
+		sessions:  map[string]*session{},
+	}
+}
+
+// attach gives sess a new token and connection, the caller holds the lock.
+// The client only gets the token if it can resume with it.
+func (t *sessionTable) attach(sess *session) (*sessionConn, error) {
+	token := make([]byte, sessionTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	conn := &sessionConn{
+		alive: newKeepalive(t.keepalive),
+		kick:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if t.timeout > 0 {
+		conn.token = token
+	}
+
+	delete(t.sessions, sess.token)
+	if sess.timer != nil {
+		sess.timer.Stop()
+		sess.timer = nil
+	}
+	sess.token, sess.conn = string(token), conn
+	t.sessions[sess.token] = sess
+	return conn, nil
+}
+
+func (t *sessionTable) open(user *User, nat_info NatInfo) (*session, *sessionConn, error) {
+	sess := &session{user: user, nat_info: nat_info}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	conn, err := t.attach(sess)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sess, conn, nil
+}
+
+// resume takes over the session of token, waiting up to resumeWait for a
+// connection that still holds it to let go
+func (t *sessionTable) resume(token []byte, identity string) (*session, *sessionConn, error) {
+	t.lock.Lock()
+	sess, ok := t.sessions[string(token)]
+	if !ok {
+		t.lock.Unlock()
+		return nil, nil, fmt.Errorf("session expired")
+	}
+	if len(identity) > 0 && identity != sess.user.Name {
+		t.lock.Unlock()
+		return nil, nil, fmt.Errorf("session of %s resumed with certificate of %s", sess.user.Name, identity)
+	}
+	old := sess.conn
+	conn, err := t.attach(sess)
+	if err != nil {
+		t.lock.Unlock()
+		return nil, nil, err
+	}
+	if old != nil {
+		close(old.kick)
+		sess.kicked = old.done
+	}
+	kicked := sess.kicked
+	t.lock.Unlock()
+
+	if kicked != nil {
+		select {
+		case <-kicked:
+		case <-time.After(resumeWait):
+			t.detach(sess, conn)
+			return nil, nil, fmt.Errorf("session of %s still held by its last connection", sess.user.Name)
+		}
+	}
+	return sess, conn, nil
+}
+
+// detach lets go of conn, the session ends after the timeout unless it is
+// resumed by then
+func (t *sessionTable) detach(sess *session, conn *sessionConn) {
+	t.leave(sess, conn, true)
+}
+
+// end lets go of conn and ends the session right away, for clients that
+// said goodbye
+func (t *sessionTable) end(sess *session, conn *sessionConn) {
+	t.leave(sess, conn, false)
+}
+
+func (t *sessionTable) leave(sess *session, conn *sessionConn, resumable bool) {
+	defer close(conn.done)
+	conn.alive.Stop()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if sess.conn != conn {
+		return
+	}
+	sess.conn = nil
+	if !resumable || t.timeout == 0 {
+		delete(t.sessions, sess.token)
+		t.release(sess.nat_info)
+		return
+	}
+	sess.timer = time.AfterFunc(t.timeout, func() { t.expire(sess) })
+}
+
+// configure applies to connections attached and sessions detached from now
+// on
+func (t *sessionTable) configure(timeout time.Duration, kc keepaliveConfig) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.timeout, t.keepalive = timeout, kc
+}
+
+func (t *sessionTable) expire(sess *session) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if sess.conn != nil || t.sessions[sess.token] != sess {
+		return
+	}
+	delete(t.sessions, sess.token)
+	t.release(sess.nat_info)
+}
+
+func (t *sessionTable) status() []SessionStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	list := make([]SessionStatus, 0, len(t.sessions))
+	for _, sess := range t.sessions {
+		st := SessionStatus{User: sess.user.Name, IP: sess.nat_info.IP, IP6: sess.nat_info.IP6}
+		if sess.conn != nil {
+			st.Connected = true
+			st.RTT = sess.conn.alive.RTT()
+		}
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return bytes.Compare(list[i].IP.To16(), list[j].IP.To16()) < 0
+	})
+	return list
+}
@@ -1,133 +1,101 @@
 package secretun
 
 import (
-	"bytes"
 	"crypto/tls"
-	"encoding/binary"
-	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
+const tcpHandshakeTimeout = 10 * time.Second
+
 type RawTCP_ST struct {
-	conn net.Listener
+	conn   net.Listener
+	accept chan ClientChan
+	err    chan error
+	closed chan struct{}
+	// shutdown_once closes closed, Shutdown may be called twice
+	shutdown_once sync.Once
 }
 
 type RawTCP_CT struct {
 	conn net.Conn
 }
 
-func packetTunnel(conn net.Conn, cli_ch ClientChan) {
-
-	go func() {
-		var size uint16
-		var header [2]byte
-
-		for {
-			if _, err := io.ReadFull(conn, header[:]); err != nil {
-				cli_ch.End <- err
-				return
-			}
-			size = binary.BigEndian.Uint16(header[:])
-			data := make([]byte, size)
-			if _, err := io.ReadFull(conn, data); err != nil {
-				cli_ch.End <- err
-				return
-			}
-
-			if packet, err := DeserializePacket(data); err != nil {
-				cli_ch.End <- err
-				return
-			} else {
-				cli_ch.R <- packet
-			}
-		}
-	}()
-	go func() {
-		for {
-			packet, ok := <-cli_ch.W
-			if !ok {
-				return
-			}
-			data, err := packet.Serialize()
-			if err != nil {
-				cli_ch.End <- err
-				return
-			}
-
-			size := len(data)
-			buf := make([]byte, 0, 2+len(data))
-			w := bytes.NewBuffer(buf)
-			w.WriteByte(byte(size >> 8))
-			w.WriteByte(byte(size & 0xFF))
-			w.Write(data)
-			if _, err = conn.Write(w.Bytes()); err != nil {
-				cli_ch.End <- err
-				return
-			}
-		}
-	}()
-}
-
 func (t *RawTCP_ST) Init(cfg Config) (err error) {
-	var certFile, keyFile, addr string
-	var cert tls.Certificate
+	var addr string
 
 	if err = cfg.Get("addr", &addr); err != nil {
 		return
 	}
-
-	if cfg.GetBool("tls") {
-		if err := cfg.Get("cert", &certFile); err != nil {
-			return err
-		} else if err := cfg.Get("key", &keyFile); err != nil {
-			return err
-		} else if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
-			return err
-		}
-		tls_cfg := &tls.Config{}
-		tls_cfg.NextProtos = []string{"http/1.1"}
-		tls_cfg.Certificates = []tls.Certificate{cert}
-		if l, err := net.Listen("tcp", addr); err != nil {
-			return err
-		} else {
-			t.conn = tls.NewListener(l, tls_cfg)
-		}
-	} else {
-		t.conn, err = net.Listen("tcp", addr)
+	if t.conn, err = listen(cfg, addr); err != nil {
+		return
 	}
+	t.accept = make(chan ClientChan)
+	t.err = make(chan error, 1)
+	t.closed = make(chan struct{})
 
 	log.Println("listen on ", addr)
 
+	go t.acceptLoop()
 	return
 }
 
-func (t *RawTCP_ST) Accept() (cli_ch ClientChan, err error) {
-	var conn net.Conn
-	conn, err = t.conn.Accept()
-	if err != nil {
-		return
-	}
-
-	if tcp_conn, ok := conn.(*net.TCPConn); ok {
-		err = tcp_conn.SetNoDelay(true)
+func (t *RawTCP_ST) acceptLoop() {
+	for {
+		conn, err := t.conn.Accept()
 		if err != nil {
+			t.err <- err
 			return
 		}
-		err = tcp_conn.SetKeepAlive(true)
-		if err != nil {
+		go t.setup(conn)
+	}
+}
+
+// setup runs the tls handshake, if any, off the accept loop so a slow
+// client cannot hold up the others
+func (t *RawTCP_ST) setup(conn net.Conn) {
+	var identity string
+
+	if tls_conn, ok := conn.(*tls.Conn); ok {
+		tls_conn.SetDeadline(time.Now().Add(tcpHandshakeTimeout))
+		if err := tls_conn.Handshake(); err != nil {
+			log.Printf("tls handshake with %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
 			return
 		}
+		tls_conn.SetDeadline(time.Time{})
+		identity = peerIdentity(tls_conn.ConnectionState())
+	}
+	if tcp_conn, ok := rawConn(conn).(*net.TCPConn); ok {
+		tcp_conn.SetNoDelay(true)
+		tcp_conn.SetKeepAlive(true)
 	}
 
-	cli_ch = NewClientChan()
-	packetTunnel(conn, cli_ch)
+	cli_ch := NewClientChan()
+	cli_ch.Identity = identity
+	packetTunnel(newStreamConn(conn), cli_ch)
+	select {
+	case t.accept <- cli_ch:
+	case <-t.closed:
+		cli_ch.Close()
+	}
+}
 
-	return cli_ch, nil
+func (t *RawTCP_ST) Accept() (ClientChan, error) {
+	select {
+	case cli_ch := <-t.accept:
+		return cli_ch, nil
+	case err := <-t.err:
+		return ClientChan{}, err
+	}
 }
 
+// Shutdown closes the listener, connections already accepted stay up
 func (t *RawTCP_ST) Shutdown() error {
-	return nil
+	t.shutdown_once.Do(func() { close(t.closed) })
+	return t.conn.Close()
 }
 
 func (t *RawTCP_CT) Init(cfg Config) (err error) {
@@ -138,36 +106,45 @@ func (t *RawTCP_CT) Init(cfg Config) (err error) {
 
 	log.Println("connect to ", addr)
 
+	if t.conn, err = net.Dial("tcp", addr); err != nil {
+		return
+	}
+	tcp_conn := t.conn.(*net.TCPConn)
+	if err = tcp_conn.SetNoDelay(true); err != nil {
+		return
+	} else if err = tcp_conn.SetKeepAlive(true); err != nil {
+		return
+	}
+
 	if cfg.GetBool("tls") {
-		tls_cfg := &tls.Config{}
-		tls_cfg.InsecureSkipVerify = true
-		if t.conn, err = tls.Dial("tcp", addr, tls_cfg); err != nil {
+		var tls_cfg *tls.Config
+		if tls_cfg, err = clientTLSConfig(cfg); err != nil {
+			tcp_conn.Close()
 			return
 		}
-	} else {
-		if t.conn, err = net.Dial("tcp", addr); err != nil {
-			return
+		if len(tls_cfg.ServerName) == 0 {
+			tls_cfg.ServerName, _, _ = net.SplitHostPort(addr)
 		}
-	}
-
-	if tcp_conn, ok := t.conn.(*net.TCPConn); ok {
-		if err = tcp_conn.SetNoDelay(true); err != nil {
-			return
+		if t.conn, err = dialTLS(tcp_conn, tls_cfg); err != nil {
+			tcp_conn.Close()
 		}
-
-		err = tcp_conn.SetKeepAlive(true)
 	}
-
 	return
 }
 
 func (t *RawTCP_CT) Start(cli_ch ClientChan) error {
-	packetTunnel(t.conn, cli_ch)
+	packetTunnel(newStreamConn(t.conn), cli_ch)
 	return nil
 }
 
+func (t *RawTCP_CT) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+// Shutdown closes a connection that was never started, a started one is
+// closed by its ClientChan
 func (t *RawTCP_CT) Shutdown() error {
-	return nil
+	return t.conn.Close()
 }
 
 func init() {
@@ -0,0 +1,198 @@
+package secretun
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+)
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("tls: load ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tls: no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+func loadKeyPair(cfg Config, required bool) ([]tls.Certificate, error) {
+	var certFile, keyFile string
+
+	if err := cfg.GetOptional("cert", &certFile); err != nil {
+		return nil, err
+	} else if err := cfg.GetOptional("key", &keyFile); err != nil {
+		return nil, err
+	}
+	if len(certFile) == 0 && len(keyFile) == 0 && !required {
+		return nil, nil
+	}
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		return nil, fmt.Errorf("tls: both cert and key are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: load %s: %v", certFile, err)
+	}
+	return []tls.Certificate{cert}, nil
+}
+
+func serverTLSConfig(cfg Config) (tls_cfg *tls.Config, err error) {
+	var client_ca, client_auth string
+
+	tls_cfg = &tls.Config{}
+	tls_cfg.NextProtos = []string{"http/1.1"}
+	if tls_cfg.Certificates, err = loadKeyPair(cfg, true); err != nil {
+		return nil, err
+	}
+
+	if err = cfg.GetOptional("client_ca", &client_ca); err != nil {
+		return
+	} else if err = cfg.GetOptional("client_auth", &client_auth); err != nil {
+		return
+	}
+	switch client_auth {
+	case "", "none":
+		tls_cfg.ClientAuth = tls.NoClientCert
+	case "request":
+		tls_cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tls_cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("tls: invalid client_auth: %s", client_auth)
+	}
+	if tls_cfg.ClientAuth != tls.NoClientCert {
+		if len(client_ca) == 0 {
+			return nil, fmt.Errorf("tls: client_auth needs client_ca")
+		}
+		if tls_cfg.ClientCAs, err = loadCertPool(client_ca); err != nil {
+			return nil, err
+		}
+	}
+	return tls_cfg, nil
+}
+
+// pins are base64 SHA-256 hashes of the server's SubjectPublicKeyInfo,
+// optionally prefixed with "sha256/"
+func parsePins(pins []string) ([][]byte, error) {
+	hashes := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("tls: invalid pin: %s", pin)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+func verifyPins(hashes [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return fmt.Errorf("tls: server sent no certificate")
+		}
+		leaf, err := x509.ParseCertificate(raw[0])
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		for _, hash := range hashes {
+			if bytes.Equal(hash, sum[:]) {
+				return nil
+			}
+		}
+		return fmt.Errorf("tls: server key sha256/%s matches no pin",
+			base64.StdEncoding.EncodeToString(sum[:]))
+	}
+}
+
+func clientTLSConfig(cfg Config) (tls_cfg *tls.Config, err error) {
+	var ca string
+	var pins []string
+
+	tls_cfg = &tls.Config{}
+	if err = cfg.GetOptional("server_name", &tls_cfg.ServerName); err != nil {
+		return
+	} else if err = cfg.GetOptional("ca", &ca); err != nil {
+		return
+	} else if err = cfg.GetOptional("pin", &pins); err != nil {
+		return
+	}
+	if tls_cfg.Certificates, err = loadKeyPair(cfg, false); err != nil {
+		return nil, err
+	}
+
+	if cfg.GetBool("insecure") {
+		log.Println("WARNING: tls certificate verification disabled")
+		tls_cfg.InsecureSkipVerify = true
+		return tls_cfg, nil
+	}
+
+	if len(ca) > 0 {
+		if tls_cfg.RootCAs, err = loadCertPool(ca); err != nil {
+			return nil, err
+		}
+	}
+	if len(pins) > 0 {
+		hashes, err := parsePins(pins)
+		if err != nil {
+			return nil, err
+		}
+		// without a ca the pin alone identifies the server, which allows
+		// self-signed certificates
+		tls_cfg.InsecureSkipVerify = len(ca) == 0
+		tls_cfg.VerifyPeerCertificate = verifyPins(hashes)
+	}
+	return tls_cfg, nil
+}
+
+func dialTLS(conn net.Conn, tls_cfg *tls.Config) (*tls.Conn, error) {
+	tls_conn := tls.Client(conn, tls_cfg)
+	if err := tls_conn.Handshake(); err != nil {
+		return nil, fmt.Errorf("verify server certificate of %s: %v", conn.RemoteAddr(), err)
+	}
+	return tls_conn, nil
+}
+
+// peerIdentity is the common name of a verified client certificate
+func peerIdentity(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+func listen(cfg Config, addr string) (net.Listener, error) {
+	var tls_cfg *tls.Config
+	var err error
+
+	if cfg.GetBool("tls") {
+		if tls_cfg, err = serverTLSConfig(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil || tls_cfg == nil {
+		return l, err
+	}
+	return tls.NewListener(l, tls_cfg), nil
+}
+
+// rawConn is the transport connection under a tls one
+func rawConn(conn net.Conn) net.Conn {
+	if tls_conn, ok := conn.(*tls.Conn); ok {
+		return tls_conn.NetConn()
+	}
+	return conn
+}
@@ -2,26 +2,253 @@ package secretun
 
 import (
 	"fmt"
+	"net"
 	"reflect"
+	"time"
 )
 
+// flushTimeout bounds how long CloseWait waits for the tunnel
+const flushTimeout = 2 * time.Second
+
+// ClientChan connects a tunnel to its consumer. The tunnel delivers on R
+// and reports the first error on End; the consumer sends on W and calls
+// Close once it is done, which tells the tunnel to stop. The tunnel still
+// writes what was queued on W before and closes stopped once it wrote its
+// last packet. PT_P2P packets are released by whoever consumes them last,
+// the tunnel once they are written. Identity is set by tunnels that
+// authenticate the peer themselves, e.g. with a verified TLS client
+// certificate.
 type ClientChan struct {
-	R   chan *Packet
-	W   chan *Packet
-	End chan error
+	R        chan *Packet
+	W        chan *Packet
+	End      chan error
+	Done     chan struct{}
+	Identity string
+
+	stopped chan struct{}
+	codec   *codec
 }
 
 func NewClientChan() (c ClientChan) {
-	c.R = make(chan *Packet)
-	c.W = make(chan *Packet)
-	c.End = make(chan error)
+	c.R = make(chan *Packet, packetQueueSize)
+	c.W = make(chan *Packet, packetQueueSize)
+	c.End = make(chan error, 1)
+	c.Done = make(chan struct{})
+	c.stopped = make(chan struct{})
+	c.codec = newCodec(c.Done)
 	return c
 }
 
 func (c *ClientChan) Close() {
-	close(c.R)
-	close(c.W)
-	close(c.End)
+	close(c.Done)
+}
+
+// CloseWait closes c and waits up to timeout for the tunnel to stop, so a
+// packet sent right before, like PT_SHUTDOWN, is on the wire
+func (c *ClientChan) CloseWait(timeout time.Duration) {
+	c.Close()
+	select {
+	case <-c.stopped:
+	case <-time.After(timeout):
+	}
+}
+
+func (c *ClientChan) Recv() (*Packet, error) {
+	select {
+	case p := <-c.R:
+		return p, nil
+	case err := <-c.End:
+		return nil, err
+	case <-c.Done:
+		return nil, fmt.Errorf("tunnel closed")
+	}
+}
+
+func (c *ClientChan) deliver(p *Packet) bool {
+	select {
+	case c.R <- p:
+		return true
+	case <-c.Done:
+		return false
+	}
+}
+
+func (c *ClientChan) fail(err error) {
+	select {
+	case c.End <- err:
+	default:
+	}
+}
+
+// next waits for a packet to send and returns it along with whatever else
+// is queued, up to maxBatch. Once c is closed it returns what is left
+// without waiting, an empty batch means the tunnel is done.
+func (c *ClientChan) next(batch []*Packet) []*Packet {
+	batch = batch[:0]
+	select {
+	case p := <-c.W:
+		batch = append(batch, p)
+	case <-c.Done:
+	}
+	for len(batch) < maxBatch {
+		select {
+		case p := <-c.W:
+			batch = append(batch, p)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+func releaseAll(batch []*Packet) {
+	for _, p := range batch {
+		p.Release()
+	}
+}
+
+// frameConn carries frames. ReadFrame may return a pooled buffer,
+// WriteFrames sends a batch in as few system calls as it can.
+type frameConn interface {
+	ReadFrame() ([]byte, error)
+	WriteFrames([][]byte) error
+	Close() error
+}
+
+// packetTunnel pumps packets between cli_ch and a connection carrying one
+// serialized packet per frame. The writer closes conn so a packet sent
+// right before Close, like a refused AuthResult, still goes out.
+func packetTunnel(conn frameConn, cli_ch ClientChan) {
+	go readLoop(&cli_ch, conn.ReadFrame)
+	go func() {
+		defer close(cli_ch.stopped)
+		defer conn.Close()
+		writeLoop(&cli_ch, 0, conn.WriteFrames)
+	}()
+}
+
+// readLoop decodes the frames read returns and delivers them until either
+// fails
+func readLoop(cli_ch *ClientChan, read func() ([]byte, error)) {
+	workers := cli_ch.codec.workers()
+	if workers == 1 {
+		for {
+			data, err := read()
+			if err != nil {
+				cli_ch.fail(err)
+				return
+			}
+			if packet, err := cli_ch.codec.decode(data); err != nil {
+				cli_ch.fail(err)
+				return
+			} else if !cli_ch.deliver(packet) {
+				return
+			}
+		}
+	}
+
+	// the flow is only known once a frame is decoded, so frames go round
+	// robin
+	dec := newPipeline(workers, cli_ch.codec.decode, cli_ch.Done)
+	go func() {
+		for i := uint32(0); ; i++ {
+			data, err := read()
+			if err != nil {
+				dec.close(err)
+				return
+			} else if !dec.submit(i, data) {
+				return
+			}
+		}
+	}()
+	for {
+		packet, ok, err := dec.next()
+		if err != nil {
+			cli_ch.fail(err)
+			return
+		} else if !ok || !cli_ch.deliver(packet) {
+			return
+		}
+	}
+}
+
+type encodedPacket struct {
+	packet *Packet
+	frame  []byte
+}
+
+// writeLoop encodes the packets sent on cli_ch, with reserve bytes in front
+// for the transport, and hands them to write in batches. It returns once
+// cli_ch is closed and what was queued before went out. The first error
+// is reported on End, packets sent after it are dropped.
+func writeLoop(cli_ch *ClientChan, reserve int, write func([][]byte) error) {
+	var err error
+	flush := func(batch []*Packet, frames [][]byte, encode_err error) {
+		if err == nil {
+			if err = encode_err; err == nil {
+				err = write(frames)
+			}
+			if err != nil {
+				cli_ch.fail(err)
+			}
+		}
+		releaseAll(batch)
+	}
+	var batch []*Packet
+	var frames [][]byte
+
+	workers := cli_ch.codec.workers()
+	if workers == 1 {
+		for {
+			if batch = cli_ch.next(batch); len(batch) == 0 {
+				return
+			}
+			var encode_err error
+			frames = frames[:0]
+			for _, p := range batch {
+				var frame []byte
+				if frame, encode_err = cli_ch.codec.encode(p, reserve); encode_err != nil {
+					break
+				}
+				frames = append(frames, frame)
+			}
+			flush(batch, frames, encode_err)
+		}
+	}
+
+	// one flow always lands on the same worker
+	enc := newPipeline(workers, func(p *Packet) (encodedPacket, error) {
+		frame, err := cli_ch.codec.encode(p, reserve)
+		return encodedPacket{p, frame}, err
+	}, nil)
+	go func() {
+		var batch []*Packet
+		for {
+			if batch = cli_ch.next(batch); len(batch) == 0 {
+				enc.close(nil)
+				return
+			}
+			for _, p := range batch {
+				enc.submit(p.flow(), p)
+			}
+		}
+	}()
+	for {
+		e, ok, encode_err := enc.next()
+		if !ok {
+			return
+		}
+		batch, frames = batch[:0], frames[:0]
+		for {
+			batch = append(batch, e.packet)
+			frames = append(frames, e.frame)
+			if encode_err != nil || !enc.pending() || len(batch) == maxBatch {
+				break
+			}
+			e, _, encode_err = enc.next()
+		}
+		flush(batch, frames, encode_err)
+	}
 }
 
 type ClientTunnel interface {
@@ -30,6 +257,15 @@ type ClientTunnel interface {
 	Shutdown() error
 }
 
+type remoteAddrer interface {
+	RemoteAddr() net.Addr
+}
+
+// datagramTunnel is implemented by tunnels that may lose or reorder packets
+type datagramTunnel interface {
+	datagram()
+}
+
 type ServerTunnel interface {
 	Init(Config) error
 	Accept() (ClientChan, error)
@@ -0,0 +1,399 @@
+package secretun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Every datagram carries one serialized Packet behind an 8 byte session id,
+// so the server finds the session no matter which address it came from.
+const (
+	udpHeaderSize  = 8
+	udpMaxDatagram = 65535
+	udpQueueSize   = 64
+)
+
+type UDP_ST struct {
+	conn     *net.UDPConn
+	timeout  time.Duration
+	lock     sync.Mutex
+	sessions map[uint64]*udpSession
+	closed   map[uint64]time.Time
+	accept   chan ClientChan
+	done     chan struct{}
+	// shutdown_once closes done, Shutdown may be called twice
+	shutdown_once sync.Once
+}
+
+type UDP_CT struct {
+	conn *net.UDPConn
+	id   uint64
+}
+
+type udpSession struct {
+	id     uint64
+	cli_ch ClientChan
+	in     chan *udpInput
+	lock   sync.Mutex
+	addr   *net.UDPAddr
+	last   time.Time
+}
+
+type udpInput struct {
+	addr   *net.UDPAddr
+	data   []byte
+	packet *Packet
+}
+
+func (t *UDP_ST) datagram() {}
+func (t *UDP_CT) datagram() {}
+
+func (s *udpSession) remote() *net.UDPAddr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.addr
+}
+
+// seen is told where each packet of s came from. Only sealed packets,
+// which nobody can forge without the key, may move the session; on an
+// unsealed one anybody who saw the id could take the downlink.
+func (s *udpSession) seen(addr *net.UDPAddr, sealed bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.addr == nil || !s.addr.IP.Equal(addr.IP) || s.addr.Port != addr.Port {
+		if s.addr != nil && !sealed {
+			return false
+		}
+		if s.addr != nil {
+			log.Printf("udp session %x moved %s -> %s", s.id, s.addr, addr)
+		}
+		s.addr = addr
+	}
+	s.last = time.Now()
+	return true
+}
+
+func (s *udpSession) idle() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return time.Since(s.last)
+}
+
+// udpWriteLoop sends every frame in a datagram of its own, no sendmmsg in
+// the standard library
+func udpWriteLoop(id uint64, cli_ch *ClientChan, send func([]byte) error) {
+	writeLoop(cli_ch, udpHeaderSize, func(frames [][]byte) error {
+		for _, buf := range frames {
+			if len(buf) > udpMaxDatagram {
+				log.Printf("udp: packet too large (%d bytes)", len(buf)-udpHeaderSize)
+				continue
+			}
+			binary.BigEndian.PutUint64(buf, id)
+			if err := send(buf); err != nil {
+				// the path may come back, e.g. while roaming between networks
+				log.Println("udp:", err)
+			}
+		}
+		return nil
+	})
+}
+
+// udpReadLoop decodes datagrams from in and delivers them. seen is told
+// where each came from and whether it was sealed, packets it turns down
+// are dropped.
+func udpReadLoop(cli_ch *ClientChan, in <-chan *udpInput, seen func(*net.UDPAddr, bool) bool) {
+	decode := func(in *udpInput) (*udpInput, error) {
+		var err error
+		if in.packet, err = cli_ch.codec.decode(in.data); err != nil {
+			putBuffer(in.data)
+		}
+		return in, err
+	}
+	deliver := func(in *udpInput, err error) bool {
+		if err != nil {
+			// junk or spoofed datagram, keep the session
+			return true
+		}
+		if !seen(in.addr, sealedFrame(in.data)) {
+			in.packet.Release()
+			return true
+		}
+		return cli_ch.deliver(in.packet)
+	}
+
+	workers := cli_ch.codec.workers()
+	if workers == 1 {
+		for {
+			select {
+			case in := <-in:
+				if !deliver(decode(in)) {
+					return
+				}
+			case <-cli_ch.Done:
+				return
+			}
+		}
+	}
+
+	dec := newPipeline(workers, decode, cli_ch.Done)
+	go func() {
+		for i := uint32(0); ; i++ {
+			select {
+			case in := <-in:
+				if !dec.submit(i, in) {
+					return
+				}
+			case <-cli_ch.Done:
+				return
+			}
+		}
+	}()
+	for {
+		in, ok, err := dec.next()
+		if !ok || !deliver(in, err) {
+			return
+		}
+	}
+}
+
+// udpPayload copies a datagram out of the read buffer into a pooled one
+func udpPayload(datagram []byte) []byte {
+	data := getBuffer(len(datagram) - udpHeaderSize)
+	copy(data, datagram[udpHeaderSize:])
+	return data
+}
+
+func (t *UDP_ST) Init(cfg Config) (err error) {
+	var addr string
+	var timeout int
+
+	if err = cfg.Get("addr", &addr); err != nil {
+		return
+	}
+	if err = cfg.Get("timeout", &timeout); err != nil {
+		if err.(*ConfigError).Errno != ErrMissing {
+			return
+		}
+		timeout = 300
+	}
+	t.timeout = time.Duration(timeout) * time.Second
+
+	uaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+	if t.conn, err = net.ListenUDP("udp", uaddr); err != nil {
+		return
+	}
+	t.sessions = map[uint64]*udpSession{}
+	t.closed = map[uint64]time.Time{}
+	t.accept = make(chan ClientChan, udpQueueSize)
+	t.done = make(chan struct{})
+
+	log.Println("listen on udp", addr)
+
+	go t.readLoop()
+	if t.timeout > 0 {
+		go t.expireLoop()
+	}
+	return nil
+}
+
+// session finds the session of id, or starts one if payload opens a
+// connection, so junk with a new id costs nothing
+func (t *UDP_ST) session(id uint64, payload []byte) *udpSession {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if s, ok := t.sessions[id]; ok {
+		return s
+	}
+	if _, ok := t.closed[id]; ok || !openingFrame(payload) {
+		return nil
+	}
+
+	s := &udpSession{id: id, cli_ch: NewClientChan(), in: make(chan *udpInput, udpQueueSize)}
+	s.last = time.Now()
+	t.sessions[id] = s
+	go t.serve(s)
+
+	select {
+	case t.accept <- s.cli_ch:
+	default:
+		log.Println("udp: accept queue full, dropping session")
+		s.cli_ch.Close()
+	}
+	return s
+}
+
+func (t *UDP_ST) remove(s *udpSession) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.sessions, s.id)
+	t.closed[s.id] = time.Now()
+}
+
+func (t *UDP_ST) readLoop() {
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, addr, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("udp:", err)
+			}
+			return
+		}
+		if n <= udpHeaderSize {
+			continue
+		}
+
+		s := t.session(binary.BigEndian.Uint64(buf[:udpHeaderSize]), buf[udpHeaderSize:n])
+		if s == nil {
+			continue
+		}
+		data := udpPayload(buf[:n])
+		select {
+		case s.in <- &udpInput{addr: addr, data: data}:
+		default:
+			putBuffer(data)
+		}
+	}
+}
+
+func (t *UDP_ST) serve(s *udpSession) {
+	defer t.remove(s)
+	defer close(s.cli_ch.stopped)
+
+	go udpReadLoop(&s.cli_ch, s.in, s.seen)
+	udpWriteLoop(s.id, &s.cli_ch, func(buf []byte) error {
+		if addr := s.remote(); addr != nil {
+			_, err := t.conn.WriteToUDP(buf, addr)
+			return err
+		}
+		return nil
+	})
+}
+
+func (t *UDP_ST) expireLoop() {
+	tick := time.NewTicker(t.timeout / 4)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-t.done:
+			return
+		}
+		t.lock.Lock()
+		for _, s := range t.sessions {
+			if s.idle() > t.timeout {
+				s.cli_ch.fail(fmt.Errorf("udp session %x timed out", s.id))
+			}
+		}
+		for id, at := range t.closed {
+			if time.Since(at) > t.timeout {
+				delete(t.closed, id)
+			}
+		}
+		t.lock.Unlock()
+	}
+}
+
+func (t *UDP_ST) Accept() (ClientChan, error) {
+	select {
+	case cli_ch := <-t.accept:
+		return cli_ch, nil
+	case <-t.done:
+		return ClientChan{}, net.ErrClosed
+	}
+}
+
+// Shutdown closes the socket. Every session shares it, so the server only
+// calls this once its clients are gone.
+func (t *UDP_ST) Shutdown() error {
+	t.shutdown_once.Do(func() { close(t.done) })
+	return t.conn.Close()
+}
+
+func (t *UDP_CT) Init(cfg Config) (err error) {
+	var addr string
+	if err = cfg.Get("addr", &addr); err != nil {
+		return
+	}
+
+	var id [udpHeaderSize]byte
+	if _, err = rand.Read(id[:]); err != nil {
+		return
+	}
+	t.id = binary.BigEndian.Uint64(id[:])
+
+	log.Println("connect to udp", addr)
+
+	uaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+	t.conn, err = net.DialUDP("udp", nil, uaddr)
+	return
+}
+
+func (t *UDP_CT) Start(cli_ch ClientChan) error {
+	in := make(chan *udpInput, udpQueueSize)
+	go func() {
+		buf := make([]byte, udpMaxDatagram)
+		for {
+			n, err := t.conn.Read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				cli_ch.fail(err)
+				return
+			} else if err != nil {
+				// ICMP errors come back here, the server may be reachable again later
+				log.Println("udp:", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			if n <= udpHeaderSize || binary.BigEndian.Uint64(buf[:udpHeaderSize]) != t.id {
+				continue
+			}
+
+			select {
+			case in <- &udpInput{data: udpPayload(buf[:n])}:
+			case <-cli_ch.Done:
+				return
+			}
+		}
+	}()
+	go udpReadLoop(&cli_ch, in, func(*net.UDPAddr, bool) bool { return true })
+
+	go func() {
+		// closing here lets a packet sent right before Close go out, and
+		// wakes the reader
+		defer close(cli_ch.stopped)
+		defer t.conn.Close()
+		udpWriteLoop(t.id, &cli_ch, func(buf []byte) error {
+			_, err := t.conn.Write(buf)
+			return err
+		})
+	}()
+	return nil
+}
+
+func (t *UDP_CT) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+// Shutdown closes a connection that was never started, a started one is
+// closed by its ClientChan
+func (t *UDP_CT) Shutdown() error {
+	return t.conn.Close()
+}
+
+func init() {
+	RegisterClientTunnel("udp", UDP_CT{})
+	RegisterServerTunnel("udp", UDP_ST{})
+}
@@ -0,0 +1,97 @@
+package secretun
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// noPassword in the password column disables password login, e.g. for
+// users that log in with a client certificate
+const noPassword = "*"
+
+// User is an authenticated user and the settings pushed to it
+type User struct {
+	Name     string
+	Password string
+	IP       net.IP
+	IP6      net.IP
+	MTU      int
+	Routes   []net.IPNet
+}
+
+// parseUser reads one users file line:
+//
+//	username password [ip=ADDR] [ip6=ADDR] [mtu=N] [route=CIDR]...
+func parseUser(line string) (*User, error) {
+	segs := strings.Fields(line)
+	if len(segs) < 2 {
+		return nil, fmt.Errorf("invalid user line: %q", line)
+	}
+
+	u := &User{Name: segs[0], Password: segs[1]}
+	for _, opt := range segs[2:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("user %s: invalid option %q", u.Name, opt)
+		}
+
+		switch kv[0] {
+		case "ip":
+			if u.IP = net.ParseIP(kv[1]); u.IP == nil {
+				return nil, fmt.Errorf("user %s: invalid ip %q", u.Name, kv[1])
+			}
+		case "ip6":
+			if u.IP6 = net.ParseIP(kv[1]); u.IP6 == nil || u.IP6.To4() != nil {
+				return nil, fmt.Errorf("user %s: invalid ip6 %q", u.Name, kv[1])
+			}
+		case "mtu":
+			mtu, err := strconv.Atoi(kv[1])
+			if err != nil || mtu <= 0 {
+				return nil, fmt.Errorf("user %s: invalid mtu %q", u.Name, kv[1])
+			}
+			u.MTU = mtu
+		case "route":
+			_, ipnet, err := net.ParseCIDR(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %v", u.Name, err)
+			}
+			u.Routes = append(u.Routes, *ipnet)
+		default:
+			return nil, fmt.Errorf("user %s: unknown option %q", u.Name, kv[0])
+		}
+	}
+	return u, nil
+}
+
+func readUsers(path string) ([]*User, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var users []*User
+	buf := bufio.NewReader(f)
+	for {
+		line, err := buf.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line = strings.TrimSpace(line); len(line) > 0 && line[0] != '#' {
+			if u, e := parseUser(line); e != nil {
+				return nil, e
+			} else {
+				users = append(users, u)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return users, nil
+}
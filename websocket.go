@@ -0,0 +1,205 @@
+package secretun
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Just enough of RFC 6455 to carry binary messages.
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+
+	wsMaxMessage = maxFrameHeader + maxFrameSize
+	wsGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+type wsConn struct {
+	net.Conn
+	r      *bufio.Reader
+	client bool
+	wlock  sync.Mutex
+	wbuf   []byte
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func wsNewKey() (string, error) {
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key[:]), nil
+}
+
+func (ws *wsConn) readFrame() (fin bool, op byte, data []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(ws.r, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	op = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	if masked == ws.client {
+		err = fmt.Errorf("websocket: unexpected frame masking")
+		return
+	}
+
+	size := uint64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.r, ext[:]); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.r, ext[:]); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > wsMaxMessage {
+		err = fmt.Errorf("websocket: frame too large (%d bytes)", size)
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(ws.r, mask[:]); err != nil {
+			return
+		}
+	}
+	data = getBuffer(int(size))
+	if _, err = io.ReadFull(ws.r, data); err != nil {
+		putBuffer(data)
+		return
+	}
+	if masked {
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// appendWSFrame appends a whole frame with data to buf
+func (ws *wsConn) appendWSFrame(buf []byte, op byte, data []byte) ([]byte, error) {
+	header := len(buf)
+	buf = append(buf, 0x80|op, 0)
+	switch size := len(data); {
+	case size < 126:
+		buf[header+1] = byte(size)
+	case size <= 0xFFFF:
+		buf[header+1] = 126
+		buf = binary.BigEndian.AppendUint16(buf, uint16(size))
+	default:
+		buf[header+1] = 127
+		buf = binary.BigEndian.AppendUint64(buf, uint64(size))
+	}
+
+	if ws.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return nil, err
+		}
+		buf[header+1] |= 0x80
+		buf = append(buf, mask[:]...)
+		start := len(buf)
+		buf = append(buf, data...)
+		for i := range data {
+			buf[start+i] ^= mask[i%4]
+		}
+	} else {
+		buf = append(buf, data...)
+	}
+	return buf, nil
+}
+
+func (ws *wsConn) writeFrame(op byte, data []byte) error {
+	buf, err := ws.appendWSFrame(make([]byte, 0, 14+len(data)), op, data)
+	if err != nil {
+		return err
+	}
+
+	ws.wlock.Lock()
+	defer ws.wlock.Unlock()
+	_, err = ws.Conn.Write(buf)
+	return err
+}
+
+func (ws *wsConn) ReadFrame() ([]byte, error) {
+	var msg []byte
+	for {
+		fin, op, data, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case wsPing:
+			if err := ws.writeFrame(wsPong, data); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			ws.writeFrame(wsClose, nil)
+			return nil, io.EOF
+		case wsText, wsBinary, wsContinuation:
+			if msg == nil && fin {
+				return data, nil
+			}
+			if len(msg)+len(data) > wsMaxMessage {
+				return nil, fmt.Errorf("websocket: message too large")
+			}
+			msg = append(msg, data...)
+			putBuffer(data)
+		default:
+			return nil, fmt.Errorf("websocket: unknown opcode %d", op)
+		}
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// WriteFrames sends every frame as a binary message, in as few writes as
+// maxWriteSize allows
+func (ws *wsConn) WriteFrames(frames [][]byte) error {
+	ws.wlock.Lock()
+	defer ws.wlock.Unlock()
+
+	var err error
+	ws.wbuf = ws.wbuf[:0]
+	for i, frame := range frames {
+		if ws.wbuf, err = ws.appendWSFrame(ws.wbuf, wsBinary, frame); err != nil {
+			return err
+		}
+		if i == len(frames)-1 || len(ws.wbuf)+len(frames[i+1]) > maxWriteSize {
+			if _, err = ws.Conn.Write(ws.wbuf); err != nil {
+				return err
+			}
+			ws.wbuf = ws.wbuf[:0]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,397 @@
+package secretun
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// The wire format is described in PROTOCOL.md. Every frame is
+//
+//	magic "ST" | version | flags | uvarint payload length | payload
+//
+// flags are the codec's seal and frameEncoded bits. Control messages in the
+// payload are lists of tagged fields, see marshalMessage.
+const (
+	wireMagic   = "ST"
+	wireVersion = 1
+
+	// magic, version and flags, the length follows
+	frameHeaderSize = 4
+	maxFrameHeader  = frameHeaderSize + binary.MaxVarintLen32
+	maxFrameSize    = 1 << 20
+)
+
+// appendFrame puts the frame header in front of payload
+func appendFrame(flags byte, payload []byte) ([]byte, error) {
+	if len(payload) > maxFrameSize {
+		return nil, fmt.Errorf("frame too large (%d bytes)", len(payload))
+	}
+	frame := make([]byte, 0, maxFrameHeader+len(payload))
+	frame = append(frame, wireMagic...)
+	frame = append(frame, wireVersion, flags)
+	frame = binary.AppendUvarint(frame, uint64(len(payload)))
+	return append(frame, payload...), nil
+}
+
+// frameAt makes buf[off:] a frame, in place if there is room in front of it
+// for the header and another reserve bytes the caller will fill in. The
+// result starts with the reserved bytes.
+func frameAt(flags byte, buf []byte, off, reserve int) ([]byte, error) {
+	payload := buf[off:]
+	var size [binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(size[:], uint64(len(payload)))
+	if off < reserve+frameHeaderSize+n {
+		frame, err := appendFrame(flags, payload)
+		if err != nil || reserve == 0 {
+			return frame, err
+		}
+		return append(make([]byte, reserve, reserve+len(frame)), frame...), nil
+	} else if len(payload) > maxFrameSize {
+		return nil, fmt.Errorf("frame too large (%d bytes)", len(payload))
+	}
+
+	start := off - n - frameHeaderSize
+	header := buf[start:off]
+	copy(header, wireMagic)
+	header[len(wireMagic)] = wireVersion
+	header[frameHeaderSize-1] = flags
+	copy(header[frameHeaderSize:], size[:n])
+	return buf[start-reserve:], nil
+}
+
+func checkFrameHeader(header []byte) error {
+	if string(header[:len(wireMagic)]) != wireMagic {
+		return fmt.Errorf("not a secretun frame")
+	}
+	if v := header[len(wireMagic)]; v != wireVersion {
+		return fmt.Errorf("unsupported wire version %d", v)
+	}
+	return nil
+}
+
+// parseFrame checks a whole frame and returns its flags and payload
+func parseFrame(frame []byte) (flags byte, payload []byte, err error) {
+	if len(frame) < frameHeaderSize+1 {
+		return 0, nil, fmt.Errorf("short frame")
+	}
+	if err = checkFrameHeader(frame); err != nil {
+		return
+	}
+	size, n := binary.Uvarint(frame[frameHeaderSize:])
+	if n <= 0 || size != uint64(len(frame)-frameHeaderSize-n) {
+		return 0, nil, fmt.Errorf("invalid frame length")
+	}
+	return frame[frameHeaderSize-1], frame[frameHeaderSize+n:], nil
+}
+
+// readFrame reads one whole frame from a stream into a pooled buffer
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	var header [maxFrameHeader]byte
+	if _, err := io.ReadFull(r, header[:frameHeaderSize]); err != nil {
+		return nil, err
+	}
+	if err := checkFrameHeader(header[:]); err != nil {
+		return nil, err
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	} else if size > maxFrameSize {
+		return nil, fmt.Errorf("frame too large (%d bytes)", size)
+	}
+
+	head := frameHeaderSize + binary.PutUvarint(header[frameHeaderSize:], size)
+	frame := getBuffer(head + int(size))
+	copy(frame, header[:head])
+	if _, err := io.ReadFull(r, frame[head:]); err != nil {
+		putBuffer(frame)
+		return nil, err
+	}
+	return frame, nil
+}
+
+// maxWriteSize is as far as WriteFrames coalesces frames for one write
+const maxWriteSize = 64 << 10
+
+// streamConn carries frames over a byte stream, they delimit themselves
+type streamConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// plain tcp takes a batch of frames in one writev, anything else gets
+	// them copied into wbuf first
+	vectored bool
+	wbuf     []byte
+}
+
+func newStreamConn(conn net.Conn) *streamConn {
+	_, vectored := conn.(*net.TCPConn)
+	return &streamConn{Conn: conn, r: bufio.NewReader(conn), vectored: vectored}
+}
+
+func (c *streamConn) ReadFrame() ([]byte, error) {
+	return readFrame(c.r)
+}
+
+func (c *streamConn) WriteFrames(frames [][]byte) error {
+	if c.vectored || len(frames) == 1 {
+		bufs := net.Buffers(frames)
+		_, err := bufs.WriteTo(c.Conn)
+		return err
+	}
+
+	c.wbuf = c.wbuf[:0]
+	for i, frame := range frames {
+		c.wbuf = append(c.wbuf, frame...)
+		if i == len(frames)-1 || len(c.wbuf)+len(frames[i+1]) > maxWriteSize {
+			if _, err := c.Conn.Write(c.wbuf); err != nil {
+				return err
+			}
+			c.wbuf = c.wbuf[:0]
+		}
+	}
+	return nil
+}
+
+// Control messages are structs whose fields carry a wire:"N" tag. They are
+// sent as a list of
+//
+//	uvarint tag | uvarint length | value
+//
+// in which strings and byte slices, net.IP and net.IPMask included, are
+// raw bytes, ints are zigzag varints, bools one byte, tagged structs nested
+// messages and net.IPNet the address followed by the mask. A slice repeats
+// its tag once per element, a map[string]string sends every entry as a
+// nested message with the key in field 1 and the value in field 2. Zero
+// values are left out and unknown tags skipped, so fields can be added
+// without breaking older peers.
+
+type wireField struct {
+	tag   uint64
+	index int
+}
+
+var wireFields sync.Map // reflect.Type -> []wireField
+
+func messageFields(t reflect.Type) ([]wireField, error) {
+	if fields, ok := wireFields.Load(t); ok {
+		return fields.([]wireField), nil
+	}
+
+	var fields []wireField
+	for i := 0; i < t.NumField(); i++ {
+		tag, ok := t.Field(i).Tag.Lookup("wire")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseUint(tag, 10, 32)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("%s.%s: invalid wire tag %q", t, t.Field(i).Name, tag)
+		}
+		fields = append(fields, wireField{n, i})
+	}
+	wireFields.Store(t, fields)
+	return fields, nil
+}
+
+var (
+	ipNetType = reflect.TypeOf(net.IPNet{})
+	bytesType = reflect.TypeOf([]byte(nil))
+)
+
+// marshalMessage encodes a tagged struct, or a pointer to one
+func marshalMessage(msg interface{}) ([]byte, error) {
+	v := reflect.Indirect(reflect.ValueOf(msg))
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("can't marshal %T", msg)
+	}
+	return appendMessage(nil, v)
+}
+
+func appendMessage(buf []byte, v reflect.Value) ([]byte, error) {
+	fields, err := messageFields(v.Type())
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		fv := v.Field(f.index)
+		if fv.IsZero() {
+			continue
+		}
+		switch {
+		case fv.Kind() == reflect.Slice && !fv.Type().ConvertibleTo(bytesType):
+			for i := 0; i < fv.Len(); i++ {
+				if buf, err = appendField(buf, f.tag, fv.Index(i)); err != nil {
+					return nil, err
+				}
+			}
+		case fv.Kind() == reflect.Map:
+			keys := fv.MapKeys()
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+			for _, k := range keys {
+				entry := appendBytesField(nil, 1, []byte(k.String()))
+				entry = appendBytesField(entry, 2, []byte(fv.MapIndex(k).String()))
+				buf = appendBytesField(buf, f.tag, entry)
+			}
+		default:
+			if buf, err = appendField(buf, f.tag, fv); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf, nil
+}
+
+func appendBytesField(buf []byte, tag uint64, value []byte) []byte {
+	buf = binary.AppendUvarint(buf, tag)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func appendField(buf []byte, tag uint64, v reflect.Value) ([]byte, error) {
+	var value []byte
+	switch {
+	case v.Type() == ipNetType:
+		ipnet := v.Interface().(net.IPNet)
+		ip := ipnet.IP
+		if len(ipnet.Mask) == net.IPv4len {
+			ip = ip.To4()
+		}
+		value = append(append(value, ip...), ipnet.Mask...)
+	case v.Kind() == reflect.String:
+		value = []byte(v.String())
+	case v.Type().ConvertibleTo(bytesType):
+		value = v.Bytes()
+	case v.Kind() == reflect.Bool:
+		value = []byte{1}
+	case v.Kind() == reflect.Int:
+		value = binary.AppendVarint(value, v.Int())
+	case v.Kind() == reflect.Struct:
+		var err error
+		if value, err = appendMessage(nil, v); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("can't marshal %s", v.Type())
+	}
+	return appendBytesField(buf, tag, value), nil
+}
+
+// unmarshalMessage decodes data into a pointer to a tagged struct
+func unmarshalMessage(data []byte, msg interface{}) error {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("can't unmarshal into %T", msg)
+	}
+	return readMessage(data, v.Elem())
+}
+
+// nextField splits the first field off data
+func nextField(data []byte) (tag uint64, value, rest []byte, err error) {
+	tag, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, nil, fmt.Errorf("invalid field tag")
+	}
+	size, m := binary.Uvarint(data[n:])
+	if m <= 0 || size > uint64(len(data)-n-m) {
+		return 0, nil, nil, fmt.Errorf("invalid field length")
+	}
+	data = data[n+m:]
+	return tag, data[:size], data[size:], nil
+}
+
+func readMessage(data []byte, v reflect.Value) error {
+	fields, err := messageFields(v.Type())
+	if err != nil {
+		return err
+	}
+	byTag := make(map[uint64]int, len(fields))
+	for _, f := range fields {
+		byTag[f.tag] = f.index
+	}
+
+	for len(data) > 0 {
+		tag, value, rest, err := nextField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+
+		index, ok := byTag[tag]
+		if !ok {
+			continue
+		}
+		fv := v.Field(index)
+		switch {
+		case fv.Kind() == reflect.Slice && !fv.Type().ConvertibleTo(bytesType):
+			elem := reflect.New(fv.Type().Elem()).Elem()
+			if err := readField(value, elem); err != nil {
+				return err
+			}
+			fv.Set(reflect.Append(fv, elem))
+		case fv.Kind() == reflect.Map:
+			var k, val string
+			for len(value) > 0 {
+				tag, part, rest, err := nextField(value)
+				if err != nil {
+					return err
+				}
+				value = rest
+				switch tag {
+				case 1:
+					k = string(part)
+				case 2:
+					val = string(part)
+				}
+			}
+			if fv.IsNil() {
+				fv.Set(reflect.MakeMap(fv.Type()))
+			}
+			fv.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(val))
+		default:
+			if err := readField(value, fv); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readField(value []byte, v reflect.Value) error {
+	switch {
+	case v.Type() == ipNetType:
+		size := len(value) / 2
+		if size != net.IPv4len && size != net.IPv6len || len(value) != 2*size {
+			return fmt.Errorf("invalid network of %d bytes", len(value))
+		}
+		ipnet := net.IPNet{
+			IP:   append(net.IP{}, value[:size]...),
+			Mask: append(net.IPMask{}, value[size:]...),
+		}
+		v.Set(reflect.ValueOf(ipnet))
+	case v.Kind() == reflect.String:
+		v.SetString(string(value))
+	case v.Type().ConvertibleTo(bytesType):
+		v.SetBytes(append([]byte{}, value...))
+	case v.Kind() == reflect.Bool:
+		v.SetBool(len(value) > 0 && value[0] != 0)
+	case v.Kind() == reflect.Int:
+		n, size := binary.Varint(value)
+		if size <= 0 || size != len(value) {
+			return fmt.Errorf("invalid int field")
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Struct:
+		return readMessage(value, v)
+	default:
+		return fmt.Errorf("can't unmarshal %s", v.Type())
+	}
+	return nil
+}
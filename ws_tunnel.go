@@ -0,0 +1,299 @@
+package secretun
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const wsFallbackPage = `<!DOCTYPE html>
+<html>
+<head><title>Welcome</title></head>
+<body><h1>It works!</h1></body>
+</html>
+`
+
+type WS_ST struct {
+	conn     net.Listener
+	path     string
+	fallback http.Handler
+	accept   chan ClientChan
+	closed   chan struct{}
+	// shutdown_once closes closed, Shutdown may be called twice
+	shutdown_once sync.Once
+}
+
+type WS_CT struct {
+	conn *wsConn
+}
+
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t *WS_ST) Init(cfg Config) (err error) {
+	var addr, fallback string
+
+	if err = cfg.Get("addr", &addr); err != nil {
+		return
+	}
+	t.path = "/"
+	if err = cfg.GetOptional("path", &t.path); err != nil {
+		return
+	}
+	if err = cfg.GetOptional("fallback", &fallback); err != nil {
+		return
+	}
+	if len(fallback) > 0 {
+		t.fallback = http.FileServer(http.Dir(fallback))
+	} else {
+		t.fallback = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(wsFallbackPage))
+		})
+	}
+
+	if t.conn, err = listen(cfg, addr); err != nil {
+		return
+	}
+	t.accept = make(chan ClientChan)
+	t.closed = make(chan struct{})
+
+	log.Println("listen on ws", addr, t.path)
+
+	go func() {
+		err := http.Serve(t.conn, t)
+		select {
+		case <-t.closed:
+		default:
+			log.Println("ws:", err)
+		}
+	}()
+	return nil
+}
+
+func (t *WS_ST) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != t.path || !headerHas(r.Header, "Upgrade", "websocket") {
+		t.fallback.ServeHTTP(w, r)
+		return
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || len(key) == 0 ||
+		!headerHas(r.Header, "Connection", "upgrade") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		log.Println("ws:", err)
+		return
+	}
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	if tcp_conn, ok := rawConn(conn).(*net.TCPConn); ok {
+		tcp_conn.SetNoDelay(true)
+	}
+
+	cli_ch := NewClientChan()
+	if r.TLS != nil {
+		cli_ch.Identity = peerIdentity(*r.TLS)
+	}
+	packetTunnel(&wsConn{Conn: conn, r: rw.Reader}, cli_ch)
+	select {
+	case t.accept <- cli_ch:
+	case <-t.closed:
+		cli_ch.Close()
+	}
+}
+
+func (t *WS_ST) Accept() (ClientChan, error) {
+	select {
+	case cli_ch := <-t.accept:
+		return cli_ch, nil
+	case <-t.closed:
+		return ClientChan{}, net.ErrClosed
+	}
+}
+
+// Shutdown closes the listener, connections already accepted stay up
+func (t *WS_ST) Shutdown() error {
+	t.shutdown_once.Do(func() { close(t.closed) })
+	return t.conn.Close()
+}
+
+// dialProxy opens a tunnel to addr through an HTTP proxy with CONNECT
+func dialProxy(proxy, auth, addr string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if len(auth) > 0 {
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(auth)) + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy: %s", resp.Status)
+	}
+	if r.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy: unexpected data after CONNECT")
+	}
+	return conn, nil
+}
+
+func (t *WS_CT) Init(cfg Config) (err error) {
+	var addr, host, proxy, proxy_auth string
+	path := "/"
+
+	if err = cfg.Get("addr", &addr); err != nil {
+		return
+	}
+	host = addr
+	if err = cfg.GetOptional("host", &host); err != nil {
+		return
+	} else if err = cfg.GetOptional("path", &path); err != nil {
+		return
+	} else if err = cfg.GetOptional("proxy", &proxy); err != nil {
+		return
+	} else if err = cfg.GetOptional("proxy_auth", &proxy_auth); err != nil {
+		return
+	}
+
+	log.Println("connect to ws", addr, path)
+
+	var conn net.Conn
+	if len(proxy) > 0 {
+		conn, err = dialProxy(proxy, proxy_auth, addr)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return
+	}
+	if tcp_conn, ok := conn.(*net.TCPConn); ok {
+		tcp_conn.SetNoDelay(true)
+	}
+
+	scheme := "ws"
+	if cfg.GetBool("tls") {
+		var tls_cfg *tls.Config
+		if tls_cfg, err = clientTLSConfig(cfg); err != nil {
+			conn.Close()
+			return
+		}
+		if len(tls_cfg.ServerName) == 0 {
+			tls_cfg.ServerName = host
+			if h, _, e := net.SplitHostPort(host); e == nil {
+				tls_cfg.ServerName = h
+			}
+		}
+		var tls_conn *tls.Conn
+		if tls_conn, err = dialTLS(conn, tls_cfg); err != nil {
+			conn.Close()
+			return
+		}
+		conn, scheme = tls_conn, "wss"
+	}
+
+	if t.conn, err = wsHandshake(conn, scheme+"://"+host+path); err != nil {
+		conn.Close()
+	}
+	return
+}
+
+func wsHandshake(conn net.Conn, url string) (*wsConn, error) {
+	key, err := wsNewKey()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("ws: upgrade refused: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return nil, fmt.Errorf("ws: invalid Sec-WebSocket-Accept")
+	}
+	return &wsConn{Conn: conn, r: r, client: true}, nil
+}
+
+func (t *WS_CT) Start(cli_ch ClientChan) error {
+	packetTunnel(t.conn, cli_ch)
+	return nil
+}
+
+func (t *WS_CT) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+// Shutdown closes a connection that was never started, a started one is
+// closed by its ClientChan
+func (t *WS_CT) Shutdown() error {
+	return t.conn.Close()
+}
+
+func init() {
+	RegisterClientTunnel("ws", WS_CT{})
+	RegisterServerTunnel("ws", WS_ST{})
+}